@@ -0,0 +1,182 @@
+package porm
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyDecay 计算 EWMA 时新样本的权重
+const latencyDecay = 0.2
+
+// Replica 负载均衡时可以选择的从库
+type Replica interface {
+	// Index 从库在 DBConfigs 中的下标
+	Index() int
+	// Weight 从库的权重，最小为 1
+	Weight() int
+	// InFlight 正在执行的查询数
+	InFlight() int64
+	// Latency 查询耗时的 EWMA，还没有查询时为 0
+	Latency() time.Duration
+}
+
+// Balancer 从健康的从库中选择一个，replicas 不为空，返回值必须是 replicas 中的一个
+type Balancer interface {
+	Pick(replicas []Replica) Replica
+}
+
+func (r *replica) Index() int {
+	return r.status.Index
+}
+
+func (r *replica) Weight() int {
+	if r.weight < 1 {
+		return 1
+	}
+	return r.weight
+}
+
+func (r *replica) InFlight() int64 {
+	return atomic.LoadInt64(&r.inFlight)
+}
+
+func (r *replica) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&r.latency))
+}
+
+// observe 记录一次查询的耗时
+func (r *replica) observe(cost time.Duration) {
+	for {
+		old := atomic.LoadInt64(&r.latency)
+		value := int64(cost)
+		if old != 0 {
+			value = old + int64(float64(value-old)*latencyDecay)
+		}
+		if atomic.CompareAndSwapInt64(&r.latency, old, value) {
+			return
+		}
+	}
+}
+
+// NewWeightedRoundRobinBalancer 平滑的加权轮询，权重都相同时就是轮询
+func NewWeightedRoundRobinBalancer() Balancer {
+	return &weightedRoundRobin{current: make(map[int]int)}
+}
+
+type weightedRoundRobin struct {
+	mu sync.Mutex
+	// current 每个从库当前的权重，按照 Index 区分
+	current map[int]int
+}
+
+func (b *weightedRoundRobin) Pick(replicas []Replica) Replica {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best Replica
+	var total int
+	for _, r := range replicas {
+		total += r.Weight()
+		b.current[r.Index()] += r.Weight()
+		if best == nil || b.current[r.Index()] > b.current[best.Index()] {
+			best = r
+		}
+	}
+
+	b.current[best.Index()] -= total
+	return best
+}
+
+// NewRandomBalancer 随机选择
+func NewRandomBalancer() Balancer {
+	return randomBalancer{}
+}
+
+type randomBalancer struct{}
+
+func (randomBalancer) Pick(replicas []Replica) Replica {
+	return replicas[rand.Intn(len(replicas))]
+}
+
+// NewLeastInFlightBalancer 选择正在执行的查询最少的从库
+func NewLeastInFlightBalancer() Balancer {
+	return leastInFlight{}
+}
+
+type leastInFlight struct{}
+
+func (leastInFlight) Pick(replicas []Replica) Replica {
+	return pickMin(replicas, func(r Replica) float64 {
+		return float64(r.InFlight())
+	})
+}
+
+// NewLatencyBalancer 选择查询耗时的 EWMA 乘以正在执行的查询数最小的从库，还没有查询的从库优先；
+// 乘以查询数是为了慢的从库在其它从库繁忙时依然能被选到，耗时可以得到更新
+func NewLatencyBalancer() Balancer {
+	return latencyBalancer{}
+}
+
+type latencyBalancer struct{}
+
+func (latencyBalancer) Pick(replicas []Replica) Replica {
+	return pickMin(replicas, func(r Replica) float64 {
+		return float64(r.Latency()) * float64(r.InFlight()+1)
+	})
+}
+
+// pickMin 选择 score 最小的从库，从随机的位置开始，分数相同时不会都选到同一个从库
+func pickMin(replicas []Replica, score func(r Replica) float64) Replica {
+	start := rand.Intn(len(replicas))
+	best := replicas[start]
+	bestScore := score(best)
+	for i := 1; i < len(replicas); i++ {
+		r := replicas[(start+i)%len(replicas)]
+		if s := score(r); s < bestScore {
+			best, bestScore = r, s
+		}
+	}
+	return best
+}
+
+// pickReplica 使用 balancer 从可用的从库中选择，没有可用的从库时返回 nil
+func (s *MasterSlaveStorage) pickReplica() *replica {
+	healthy := make([]Replica, 0, len(s.slaves))
+	for _, slave := range s.slaves {
+		if slave.available() {
+			healthy = append(healthy, slave)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	picked, ok := s.balancer.Pick(healthy).(*replica)
+	if !ok {
+		return healthy[0].(*replica)
+	}
+	return picked
+}
+
+func (s *MasterSlaveStorage) track(orm *orm) (*DB, func(err error)) {
+	if s.useMaster(orm) {
+		return s.master.db, func(err error) {}
+	}
+
+	r := s.pickReplica()
+	if r == nil {
+		return s.master.db, func(err error) {}
+	}
+
+	start := time.Now()
+	atomic.AddInt64(&r.inFlight, 1)
+	return r.db, func(err error) {
+		atomic.AddInt64(&r.inFlight, -1)
+		// 出错的查询耗时不准确，不记录
+		if err == nil {
+			r.observe(time.Since(start))
+		}
+	}
+}
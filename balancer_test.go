@@ -0,0 +1,130 @@
+package porm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yongpi/putil/psql"
+)
+
+type fakeReplica struct {
+	index    int
+	weight   int
+	inFlight int64
+	latency  time.Duration
+}
+
+func (r *fakeReplica) Index() int             { return r.index }
+func (r *fakeReplica) Weight() int            { return r.weight }
+func (r *fakeReplica) InFlight() int64        { return r.inFlight }
+func (r *fakeReplica) Latency() time.Duration { return r.latency }
+
+func pickCount(balancer Balancer, replicas []Replica, count int) map[int]int {
+	picked := make(map[int]int)
+	for i := 0; i < count; i++ {
+		picked[balancer.Pick(replicas).Index()]++
+	}
+	return picked
+}
+
+func TestWeightedRoundRobinBalancer(t *testing.T) {
+	replicas := []Replica{&fakeReplica{index: 1, weight: 3}, &fakeReplica{index: 2, weight: 1}}
+	balancer := NewWeightedRoundRobinBalancer()
+
+	// 平滑加权，权重大的不会连续全部选中
+	var order []int
+	for i := 0; i < 4; i++ {
+		order = append(order, balancer.Pick(replicas).Index())
+	}
+	if order[0] != 1 || order[1] != 1 || order[2] != 2 || order[3] != 1 {
+		t.Errorf("smooth weighted round robin fail, order = %v", order)
+	}
+
+	picked := pickCount(balancer, replicas, 400)
+	if picked[1] != 300 || picked[2] != 100 {
+		t.Errorf("weighted round robin fail, picked = %v", picked)
+	}
+}
+
+func TestRandomBalancer(t *testing.T) {
+	replicas := []Replica{&fakeReplica{index: 1}, &fakeReplica{index: 2}, &fakeReplica{index: 3}}
+	picked := pickCount(NewRandomBalancer(), replicas, 300)
+	if len(picked) != 3 {
+		t.Errorf("random should pick all replicas, picked = %v", picked)
+	}
+}
+
+func TestLeastInFlightBalancer(t *testing.T) {
+	replicas := []Replica{&fakeReplica{index: 1, inFlight: 3}, &fakeReplica{index: 2, inFlight: 1}, &fakeReplica{index: 3, inFlight: 2}}
+	if picked := pickCount(NewLeastInFlightBalancer(), replicas, 10); picked[2] != 10 {
+		t.Errorf("least in flight fail, picked = %v", picked)
+	}
+
+	// 相同时分散到每个从库
+	replicas = []Replica{&fakeReplica{index: 1}, &fakeReplica{index: 2}}
+	if picked := pickCount(NewLeastInFlightBalancer(), replicas, 100); len(picked) != 2 {
+		t.Errorf("least in flight tie fail, picked = %v", picked)
+	}
+}
+
+func TestLatencyBalancer(t *testing.T) {
+	fast := &fakeReplica{index: 1, latency: time.Millisecond}
+	slow := &fakeReplica{index: 2, latency: 10 * time.Millisecond}
+	replicas := []Replica{slow, fast}
+	if picked := pickCount(NewLatencyBalancer(), replicas, 10); picked[1] != 10 {
+		t.Errorf("latency fail, picked = %v", picked)
+	}
+
+	// 快的从库繁忙时选择慢的从库
+	fast.inFlight = 20
+	if picked := pickCount(NewLatencyBalancer(), replicas, 10); picked[2] != 10 {
+		t.Errorf("latency with in flight fail, picked = %v", picked)
+	}
+
+	// 没有查询过的从库优先
+	replicas = append(replicas, &fakeReplica{index: 3})
+	if picked := pickCount(NewLatencyBalancer(), replicas, 10); picked[3] != 10 {
+		t.Errorf("latency without sample fail, picked = %v", picked)
+	}
+}
+
+func TestMasterSlaveBalancer(t *testing.T) {
+	sqliteORM(t)
+	ctx := context.Background()
+
+	config := masterSlaveConfig("sqlite_balancer", 2)
+	config.DBConfigs[1].Weight = 2
+	s := newMasterSlaveStorage(config)
+	r1, r2 := s.slaves[0], s.slaves[1]
+
+	if dbs := pickDBs(s, 6); dbs[r1.db] != 4 || dbs[r2.db] != 2 {
+		t.Fatalf("default balancer should be weighted round robin, dbs = %v", dbs)
+	}
+
+	// 查询记录从库的执行情况
+	o := &orm{storage: s}
+	for i := 0; i < 4; i++ {
+		if _, err := Find[*TestAuthorM](ctx, o, psql.Select("*")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range s.slaves {
+		if r.InFlight() != 0 || r.Latency() <= 0 {
+			t.Errorf("replica should be tracked, index = %d, in flight = %d, latency = %s", r.Index(), r.InFlight(), r.Latency())
+		}
+	}
+
+	// 事务中不经过从库
+	err := o.Transaction(ctx, func(ctx context.Context, to *orm) error {
+		r1.inFlight, r2.inFlight = 100, 100
+		_, err := Find[*TestAuthorM](ctx, to, psql.Select("*"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1.InFlight() != 100 || r2.InFlight() != 100 {
+		t.Errorf("tx should not use replica, in flight = %d, %d", r1.InFlight(), r2.InFlight())
+	}
+}
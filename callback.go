@@ -0,0 +1,245 @@
+package porm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+)
+
+// model 可以实现下面的接口，在对应的操作前后执行，返回错误时中止操作；列表中的每个元素都会调用
+
+type BeforeSaver interface {
+	BeforeSave(ctx context.Context) error
+}
+
+type AfterSaver interface {
+	AfterSave(ctx context.Context) error
+}
+
+type BeforeInserter interface {
+	BeforeInsert(ctx context.Context) error
+}
+
+type AfterInserter interface {
+	AfterInsert(ctx context.Context) error
+}
+
+type BeforeUpdater interface {
+	BeforeUpdate(ctx context.Context) error
+}
+
+type AfterUpdater interface {
+	AfterUpdate(ctx context.Context) error
+}
+
+type BeforeDeleter interface {
+	BeforeDelete(ctx context.Context) error
+}
+
+type AfterDeleter interface {
+	AfterDelete(ctx context.Context) error
+}
+
+type AfterFinder interface {
+	AfterFind(ctx context.Context) error
+}
+
+type modelCallback func(ctx context.Context, model interface{}) error
+
+type modelCallbacks struct {
+	before []modelCallback
+	after  []modelCallback
+	// afters after 回调的接口，model 实现了其中一个时在事务中执行
+	afters []reflect.Type
+}
+
+var (
+	insertCallbacks = modelCallbacks{
+		before: []modelCallback{callBeforeSave, callBeforeInsert},
+		after:  []modelCallback{callAfterInsert, callAfterSave},
+		afters: []reflect.Type{afterInserterType, afterSaverType},
+	}
+	updateCallbacks = modelCallbacks{
+		before: []modelCallback{callBeforeSave, callBeforeUpdate},
+		after:  []modelCallback{callAfterUpdate, callAfterSave},
+		afters: []reflect.Type{afterUpdaterType, afterSaverType},
+	}
+	deleteCallbacks = modelCallbacks{
+		before: []modelCallback{callBeforeDelete},
+		after:  []modelCallback{callAfterDelete},
+		afters: []reflect.Type{afterDeleterType},
+	}
+)
+
+var (
+	afterSaverType    = reflect.TypeOf((*AfterSaver)(nil)).Elem()
+	afterInserterType = reflect.TypeOf((*AfterInserter)(nil)).Elem()
+	afterUpdaterType  = reflect.TypeOf((*AfterUpdater)(nil)).Elem()
+	afterDeleterType  = reflect.TypeOf((*AfterDeleter)(nil)).Elem()
+
+	errCallbackFound = errors.New("callback found")
+)
+
+// withModelCallbacks 在 fun 前后执行 model 的回调；model 有 after 回调时，before 回调、fun 和 after 回调在同一个事务中执行，
+// after 回调返回错误时回滚 fun 的写入，已经在事务中时使用 savepoint
+func (o *orm) withModelCallbacks(ctx context.Context, model interface{}, callbacks modelCallbacks, fun func(ctx context.Context, o *orm) (sql.Result, error)) (sql.Result, error) {
+	if !hasModelCallbacks(model, callbacks.afters) {
+		return runWithModelCallbacks(ctx, o, model, callbacks, fun)
+	}
+
+	so, err := o.shardBy(model)
+	if err != nil {
+		return nil, err
+	}
+
+	var result sql.Result
+	err = so.Transaction(ctx, func(ctx context.Context, no *orm) error {
+		var err error
+		result, err = runWithModelCallbacks(ctx, no, model, callbacks, fun)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func runWithModelCallbacks(ctx context.Context, o *orm, model interface{}, callbacks modelCallbacks, fun func(ctx context.Context, o *orm) (sql.Result, error)) (sql.Result, error) {
+	err := runModelCallbacks(ctx, model, callbacks.before)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := fun(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	err = runModelCallbacks(ctx, model, callbacks.after)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// hasModelCallbacks model 中有元素实现了 types 中的接口
+func hasModelCallbacks(model interface{}, types []reflect.Type) bool {
+	err := eachModel(reflect.ValueOf(model), func(m interface{}) error {
+		mt := reflect.TypeOf(m)
+		for _, t := range types {
+			if mt.Implements(t) {
+				return errCallbackFound
+			}
+		}
+		return nil
+	})
+	return err == errCallbackFound
+}
+
+func runModelCallbacks(ctx context.Context, model interface{}, callbacks []modelCallback) error {
+	return eachModel(reflect.ValueOf(model), func(m interface{}) error {
+		for _, callback := range callbacks {
+			if err := callback(ctx, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// eachModel 遍历 value 中的结构体，可以取地址时传入指针，指针接收者的方法也能调用
+func eachModel(value reflect.Value, fun func(model interface{}) error) error {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Struct:
+		if value.CanAddr() {
+			return fun(value.Addr().Interface())
+		}
+		return fun(value.Interface())
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			err := eachModel(value.Index(i), fun)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// afterFindVisitor 扫描时对每个结构体调用 AfterFind
+func afterFindVisitor(ctx context.Context) func(ptr reflect.Value) error {
+	return func(ptr reflect.Value) error {
+		return callAfterFind(ctx, ptr.Interface())
+	}
+}
+
+func callBeforeSave(ctx context.Context, model interface{}) error {
+	if m, ok := model.(BeforeSaver); ok {
+		return m.BeforeSave(ctx)
+	}
+	return nil
+}
+
+func callAfterSave(ctx context.Context, model interface{}) error {
+	if m, ok := model.(AfterSaver); ok {
+		return m.AfterSave(ctx)
+	}
+	return nil
+}
+
+func callBeforeInsert(ctx context.Context, model interface{}) error {
+	if m, ok := model.(BeforeInserter); ok {
+		return m.BeforeInsert(ctx)
+	}
+	return nil
+}
+
+func callAfterInsert(ctx context.Context, model interface{}) error {
+	if m, ok := model.(AfterInserter); ok {
+		return m.AfterInsert(ctx)
+	}
+	return nil
+}
+
+func callBeforeUpdate(ctx context.Context, model interface{}) error {
+	if m, ok := model.(BeforeUpdater); ok {
+		return m.BeforeUpdate(ctx)
+	}
+	return nil
+}
+
+func callAfterUpdate(ctx context.Context, model interface{}) error {
+	if m, ok := model.(AfterUpdater); ok {
+		return m.AfterUpdate(ctx)
+	}
+	return nil
+}
+
+func callBeforeDelete(ctx context.Context, model interface{}) error {
+	if m, ok := model.(BeforeDeleter); ok {
+		return m.BeforeDelete(ctx)
+	}
+	return nil
+}
+
+func callAfterDelete(ctx context.Context, model interface{}) error {
+	if m, ok := model.(AfterDeleter); ok {
+		return m.AfterDelete(ctx)
+	}
+	return nil
+}
+
+func callAfterFind(ctx context.Context, model interface{}) error {
+	if m, ok := model.(AfterFinder); ok {
+		return m.AfterFind(ctx)
+	}
+	return nil
+}
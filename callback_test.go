@@ -0,0 +1,184 @@
+package porm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type TestCallbackM struct {
+	ID        int64 `porm:"pk"`
+	Name      string
+	Bio       string
+	CreatedAt Time
+	UpdatedAt Time `porm:"readonly"`
+
+	events []string
+}
+
+func (m *TestCallbackM) TableName() string {
+	return "author"
+}
+
+func (m *TestCallbackM) BeforeSave(ctx context.Context) error {
+	if m.Name == "" {
+		return errors.New("name can not be empty")
+	}
+	m.Name = strings.ToLower(strings.TrimSpace(m.Name))
+	m.Bio = "enc:" + m.Bio
+	m.events = append(m.events, "before save")
+	return nil
+}
+
+func (m *TestCallbackM) BeforeInsert(ctx context.Context) error {
+	m.CreatedAt.SetTime(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	m.events = append(m.events, "before insert")
+	return nil
+}
+
+func (m *TestCallbackM) AfterInsert(ctx context.Context) error {
+	m.events = append(m.events, "after insert")
+	return nil
+}
+
+func (m *TestCallbackM) AfterSave(ctx context.Context) error {
+	m.Bio = strings.TrimPrefix(m.Bio, "enc:")
+	m.events = append(m.events, "after save")
+	return nil
+}
+
+func (m *TestCallbackM) BeforeUpdate(ctx context.Context) error {
+	m.events = append(m.events, "before update")
+	return nil
+}
+
+func (m *TestCallbackM) BeforeDelete(ctx context.Context) error {
+	if m.Name == "keep" {
+		return errors.New("can not delete")
+	}
+	return nil
+}
+
+func (m *TestCallbackM) AfterFind(ctx context.Context) error {
+	m.Bio = strings.TrimPrefix(m.Bio, "enc:")
+	m.events = append(m.events, "after find")
+	return nil
+}
+
+func TestModelCallbacks(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	m := &TestCallbackM{Name: " Callback ", Bio: "secret"}
+	_, err := o.Insert(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(m.events, ",") != "before save,before insert,after insert,after save" {
+		t.Errorf("insert callbacks order fail, events = %v", m.events)
+	}
+	if m.Name != "callback" || m.Bio != "secret" || m.ID == 0 {
+		t.Errorf("insert callbacks fail, model = %+v", m)
+	}
+
+	// 列表中的每个元素都会调用，tracked 时记录的是 AfterFind 之后的值
+	var list []TestCallbackM
+	err = o.SelectPKS(WithTracking(ctx), []int64{m.ID}, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Bio != "secret" || !list[0].CreatedAt.Valid || strings.Join(list[0].events, ",") != "after find" {
+		t.Errorf("after find fail, list = %+v", list)
+	}
+
+	got, err := Get[*TestCallbackM](ctx, o, m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bio != "secret" {
+		t.Errorf("generic after find fail, model = %+v", got)
+	}
+
+	got.Name = ""
+	_, err = o.UpdateModel(ctx, got)
+	if err == nil {
+		t.Fatal("before save error should abort update")
+	}
+
+	got.Name = "Keep"
+	got.events = nil
+	_, err = o.UpdateModel(ctx, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got.events, ",") != "before save,before update,after save" {
+		t.Errorf("update callbacks fail, events = %v", got.events)
+	}
+
+	_, err = o.DeleteModel(ctx, []*TestCallbackM{got})
+	if err == nil {
+		t.Fatal("before delete error should abort delete")
+	}
+	_, err = Get[*TestCallbackM](ctx, o, m.ID)
+	if err != nil {
+		t.Errorf("aborted delete should keep row, err = %v", err)
+	}
+
+	_, err = o.Insert(ctx, []TestCallbackM{{Name: "a"}, {}})
+	if err == nil {
+		t.Fatal("before save error in list should abort insert")
+	}
+}
+
+type TestAfterFailM struct {
+	ID   int64 `porm:"pk"`
+	Name string
+}
+
+func (m *TestAfterFailM) TableName() string {
+	return "author"
+}
+
+func (m *TestAfterFailM) AfterInsert(ctx context.Context) error {
+	if m.Name == "fail" {
+		return errors.New("after insert fail")
+	}
+	return nil
+}
+
+func TestModelCallbacksRollback(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	// after 回调返回错误时回滚写入
+	_, err := o.Insert(ctx, &TestAfterFailM{ID: 10, Name: "fail"})
+	if err == nil {
+		t.Fatal("after insert error should fail insert")
+	}
+	if _, err = Get[*TestAfterFailM](ctx, o, 10); err != sql.ErrNoRows {
+		t.Errorf("after insert error should rollback insert, err = %v", err)
+	}
+
+	// 在事务中时只回滚 savepoint，外层事务的写入不受影响
+	err = o.Transaction(ctx, func(ctx context.Context, no *orm) error {
+		if _, err := no.Insert(ctx, &TestAfterFailM{ID: 11, Name: "ok"}); err != nil {
+			return err
+		}
+		if _, err := no.Insert(ctx, &TestAfterFailM{ID: 12, Name: "fail"}); err == nil {
+			return errors.New("after insert error should fail insert")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Get[*TestAfterFailM](ctx, o, 11); err != nil {
+		t.Errorf("outer insert should be committed, err = %v", err)
+	}
+	if _, err = Get[*TestAfterFailM](ctx, o, 12); err != sql.ErrNoRows {
+		t.Errorf("savepoint insert should be rolled back, err = %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package porm
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// readYourWrites 记录 context 中每个 storage 最后一次写的时间，在多个 goroutine 中共用
+type readYourWrites struct {
+	mu     sync.Mutex
+	writes map[string]time.Time
+}
+
+// WithReadYourWrites 返回的 context 写过某个 storage 之后，使用这个 context 对该 storage 的读请求都读主库，
+// storage 配置了 StickyWindow 时只在写之后的这段时间内读主库
+func WithReadYourWrites(ctx context.Context) context.Context {
+	if readYourWritesFrom(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, readWritesKey, &readYourWrites{writes: make(map[string]time.Time)})
+}
+
+func readYourWritesFrom(ctx context.Context) *readYourWrites {
+	if value, ok := ctx.Value(readWritesKey).(*readYourWrites); ok {
+		return value
+	}
+	return nil
+}
+
+func (r *readYourWrites) wrote(storageName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes[storageName] = time.Now()
+}
+
+// sticky window 小于等于 0 时写过就一直读主库
+func (r *readYourWrites) sticky(storageName string, window time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	last, ok := r.writes[storageName]
+	if !ok {
+		return false
+	}
+	return window <= 0 || time.Since(last) < window
+}
+
+// stickyWindow 写之后读主库的时间
+func (o *orm) stickyWindow() time.Duration {
+	if ms, ok := o.storage.(*MasterSlaveStorage); ok {
+		return ms.stickyWindow
+	}
+	return 0
+}
@@ -2,20 +2,79 @@ package porm
 
 import "context"
 
-var transactionKey = &contextKey{Name: "transaction_key"}
+var (
+	transactionKey = &contextKey{Name: "transaction_key"}
+	txRetryKey     = &contextKey{Name: "tx_retry_key"}
+	operationKey   = &contextKey{Name: "operation_key"}
+	readWritesKey  = &contextKey{Name: "read_your_writes_key"}
+	trackerKey     = &contextKey{Name: "tracker_key"}
+)
 
 type contextKey struct {
 	Name string
 }
 
+// txContext context 中保存的事务，按 storage 区分，每次写入时复制一份，不影响外层 context
+type txContext struct {
+	last *orm
+	orms map[string]*orm
+}
+
+func txContextFrom(ctx context.Context) *txContext {
+	if value, ok := ctx.Value(transactionKey).(*txContext); ok {
+		return value
+	}
+	return nil
+}
+
+// TxORMFromContext 返回 context 中最后加入的事务
 func TxORMFromContext(ctx context.Context) *orm {
-	value := ctx.Value(transactionKey)
-	if orm, ok := value.(*orm); ok {
-		return orm
+	if tc := txContextFrom(ctx); tc != nil {
+		return tc.last
+	}
+	return nil
+}
+
+// StorageTxORMFromContext 返回 context 中对应 storage 的事务
+func StorageTxORMFromContext(ctx context.Context, storageName string) *orm {
+	if tc := txContextFrom(ctx); tc != nil {
+		return tc.orms[storageName]
+	}
+	return nil
+}
+
+func WithTxContext(ctx context.Context, o *orm) context.Context {
+	tc := &txContext{last: o, orms: make(map[string]*orm)}
+	if parent := txContextFrom(ctx); parent != nil {
+		for name, to := range parent.orms {
+			tc.orms[name] = to
+		}
+	}
+	tc.orms[o.StorageName()] = o
+
+	return context.WithValue(ctx, transactionKey, tc)
+}
+
+// TxRetryFromContext 返回事务重试的信息，只在 BeforeTxRetry hook 中有值
+func TxRetryFromContext(ctx context.Context) *TxRetry {
+	if value, ok := ctx.Value(txRetryKey).(*TxRetry); ok {
+		return value
+	}
+	return nil
+}
+
+func withTxRetry(ctx context.Context, retry *TxRetry) context.Context {
+	return context.WithValue(ctx, txRetryKey, retry)
+}
+
+// OperationFromContext 返回正在执行的 sql 的信息，只在 BeforeExec、AfterExec hook 中有值
+func OperationFromContext(ctx context.Context) *Operation {
+	if value, ok := ctx.Value(operationKey).(*Operation); ok {
+		return value
 	}
 	return nil
 }
 
-func WithTxContext(ctx context.Context, orm *orm) context.Context {
-	return context.WithValue(ctx, transactionKey, orm)
+func withOperation(ctx context.Context, op *Operation) context.Context {
+	return context.WithValue(ctx, operationKey, op)
 }
@@ -30,8 +30,9 @@ type StmtQuery interface {
 
 type DB struct {
 	*sql.DB
-	mapper *mapper
-	Name   string
+	mapper     *mapper
+	Name       string
+	DriverName string
 }
 
 func (db *DB) Mapper() *mapper {
@@ -39,11 +40,13 @@ func (db *DB) Mapper() *mapper {
 }
 
 func (db *DB) QueryP(dest interface{}, query string, args ...interface{}) error {
-	return QueryScan(context.Background(), db, dest, query, args...)
+	return db.QueryContextP(context.Background(), dest, query, args...)
 }
 
 func (db *DB) QueryContextP(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
-	return QueryScan(ctx, db, dest, query, args...)
+	return interceptDB(ctx, db.Name, &Operation{Query: query, Args: args}, func(ctx context.Context, op *Operation) error {
+		return QueryScan(ctx, db, dest, op.Query, op.Args...)
+	})
 }
 
 func OpenDBName(driverName, dataSourceName, dbName string) (*DB, error) {
@@ -52,7 +55,7 @@ func OpenDBName(driverName, dataSourceName, dbName string) (*DB, error) {
 		return nil, err
 	}
 
-	db := &DB{DB: sqlDB, mapper: NewMapper(dbName), Name: dbName}
+	db := &DB{DB: sqlDB, mapper: NewMapper(dbName), Name: dbName, DriverName: driverName}
 	return db, nil
 }
 
@@ -66,7 +69,7 @@ func (db *DB) ConnP(ctx context.Context) (*Conn, error) {
 		return nil, err
 	}
 
-	conn := &Conn{Conn: sqlConn, mapper: db.mapper}
+	conn := &Conn{Conn: sqlConn, mapper: db.mapper, name: db.Name}
 	return conn, nil
 }
 
@@ -80,7 +83,7 @@ func (db *DB) BeginTxP(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
 		return nil, err
 	}
 
-	tx := &Tx{Tx: sqlTx, mapper: db.mapper}
+	tx := &Tx{Tx: sqlTx, mapper: db.mapper, name: db.Name}
 	return tx, nil
 }
 
@@ -90,7 +93,7 @@ func (db *DB) PrepareContextP(ctx context.Context, query string) (*Stmt, error)
 		return nil, err
 	}
 
-	stmt := &Stmt{Stmt: sqlStmt, mapper: db.mapper}
+	stmt := &Stmt{Stmt: sqlStmt, mapper: db.mapper, name: db.Name, query: query}
 	return stmt, nil
 }
 
@@ -101,6 +104,7 @@ func (db *DB) PrepareP(query string) (*Stmt, error) {
 type Conn struct {
 	*sql.Conn
 	mapper *mapper
+	name   string
 }
 
 func (c *Conn) Mapper() *mapper {
@@ -108,16 +112,19 @@ func (c *Conn) Mapper() *mapper {
 }
 
 func (c *Conn) QueryP(dest interface{}, query string, args ...interface{}) error {
-	return QueryScan(context.Background(), c, dest, query, args...)
+	return c.QueryContextP(context.Background(), dest, query, args...)
 }
 
 func (c *Conn) QueryContextP(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
-	return QueryScan(ctx, c, dest, query, args...)
+	return interceptDB(ctx, c.name, &Operation{Query: query, Args: args}, func(ctx context.Context, op *Operation) error {
+		return QueryScan(ctx, c, dest, op.Query, op.Args...)
+	})
 }
 
 type Tx struct {
 	*sql.Tx
 	mapper *mapper
+	name   string
 }
 
 func (t *Tx) Mapper() *mapper {
@@ -125,11 +132,13 @@ func (t *Tx) Mapper() *mapper {
 }
 
 func (t *Tx) QueryP(dest interface{}, query string, args ...interface{}) error {
-	return QueryScan(context.Background(), t, dest, query, args...)
+	return t.QueryContextP(context.Background(), dest, query, args...)
 }
 
 func (t *Tx) QueryContextP(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
-	return QueryScan(ctx, t, dest, query, args...)
+	return interceptDB(ctx, t.name, &Operation{Query: query, Args: args}, func(ctx context.Context, op *Operation) error {
+		return QueryScan(ctx, t, dest, op.Query, op.Args...)
+	})
 }
 
 func (t *Tx) PrepareContextP(ctx context.Context, query string) (*Stmt, error) {
@@ -138,7 +147,7 @@ func (t *Tx) PrepareContextP(ctx context.Context, query string) (*Stmt, error) {
 		return nil, err
 	}
 
-	stmt := &Stmt{Stmt: sqlStmt, mapper: t.mapper}
+	stmt := &Stmt{Stmt: sqlStmt, mapper: t.mapper, name: t.name, query: query}
 	return stmt, nil
 }
 
@@ -149,6 +158,9 @@ func (t *Tx) PrepareP(query string) (*Stmt, error) {
 type Stmt struct {
 	*sql.Stmt
 	mapper *mapper
+	name   string
+	// query 预编译的 sql，只用于拦截器，修改 Operation 的 Query 不会生效
+	query string
 }
 
 func (st *Stmt) Mapper() *mapper {
@@ -156,11 +168,13 @@ func (st *Stmt) Mapper() *mapper {
 }
 
 func (st *Stmt) QueryP(dest interface{}, args ...interface{}) error {
-	return StmtQueryScan(context.Background(), st, dest, args...)
+	return st.QueryContextP(context.Background(), dest, args...)
 }
 
 func (st *Stmt) QueryContextP(ctx context.Context, dest interface{}, args ...interface{}) error {
-	return StmtQueryScan(ctx, st, dest, args...)
+	return interceptDB(ctx, st.name, &Operation{Query: st.query, Args: args}, func(ctx context.Context, op *Operation) error {
+		return StmtQueryScan(ctx, st, dest, op.Args...)
+	})
 }
 
 func QueryScan(ctx context.Context, qi Query, dest interface{}, query string, args ...interface{}) error {
@@ -168,7 +182,7 @@ func QueryScan(ctx context.Context, qi Query, dest interface{}, query string, ar
 	if err != nil {
 		return err
 	}
-	return Scan(qi.Mapper(), dest, rows)
+	return ScanContext(ctx, qi.Mapper(), dest, rows)
 }
 
 func StmtQueryScan(ctx context.Context, qi StmtQuery, dest interface{}, args ...interface{}) error {
@@ -176,10 +190,20 @@ func StmtQueryScan(ctx context.Context, qi StmtQuery, dest interface{}, args ...
 	if err != nil {
 		return err
 	}
-	return Scan(qi.Mapper(), dest, rows)
+	return ScanContext(ctx, qi.Mapper(), dest, rows)
 }
 
 func Scan(mapper *mapper, dest interface{}, rows *sql.Rows) error {
+	return ScanContext(context.Background(), mapper, dest, rows)
+}
+
+// ScanContext 扫描结果到 dest，model 实现了 AfterFinder 时扫描后调用 AfterFind
+func ScanContext(ctx context.Context, mapper *mapper, dest interface{}, rows *sql.Rows) error {
+	return scan(mapper, dest, rows, afterFindVisitor(ctx))
+}
+
+// scan 扫描结果到 dest，visit 不为空时对每个填充好的结构体指针调用
+func scan(mapper *mapper, dest interface{}, rows *sql.Rows, visit func(reflect.Value) error) error {
 	defer func() {
 		err := rows.Close()
 		if err != nil {
@@ -200,16 +224,16 @@ func Scan(mapper *mapper, dest interface{}, rows *sql.Rows) error {
 	dv = reflect.Indirect(dv)
 
 	if dv.Kind() == reflect.Struct {
-		return scanOne(mapper, dv, rows)
+		return scanOne(mapper, dv, rows, visit)
 	}
 	if dv.Kind() == reflect.Array || dv.Kind() == reflect.Slice {
-		return scanSlice(mapper, dv, rows)
+		return scanSlice(mapper, dv, rows, visit)
 	}
 
 	return fmt.Errorf("[porm:Scan]:The type of dest is not supported")
 }
 
-func scanOne(mapper *mapper, dv reflect.Value, rows *sql.Rows) error {
+func scanOne(mapper *mapper, dv reflect.Value, rows *sql.Rows, visit func(reflect.Value) error) error {
 	if dv.Kind() != reflect.Struct {
 		return fmt.Errorf("[porm:scanOne] dv must be struct, kind = %s", dv.Kind().String())
 	}
@@ -230,12 +254,17 @@ func scanOne(mapper *mapper, dv reflect.Value, rows *sql.Rows) error {
 
 	if rows.Next() {
 		err = rows.Scan(values...)
-		return err
+		if err != nil {
+			return err
+		}
+		if visit != nil && dv.CanAddr() {
+			return visit(dv.Addr())
+		}
 	}
 	return nil
 }
 
-func scanSlice(mapper *mapper, dv reflect.Value, rows *sql.Rows) error {
+func scanSlice(mapper *mapper, dv reflect.Value, rows *sql.Rows, visit func(reflect.Value) error) error {
 	if dv.Kind() != reflect.Slice && dv.Kind() != reflect.Array {
 		return fmt.Errorf("[porm:scanSlice] dv must be array or slice, kind = %s", dv.Kind().String())
 	}
@@ -258,6 +287,7 @@ func scanSlice(mapper *mapper, dv reflect.Value, rows *sql.Rows) error {
 	if err != nil {
 		return err
 	}
+	start := dv.Len()
 	for rows.Next() {
 		dp := reflect.New(det)
 		dpe := dp.Elem()
@@ -276,6 +306,19 @@ func scanSlice(mapper *mapper, dv reflect.Value, rows *sql.Rows) error {
 		}
 	}
 
+	if visit == nil {
+		return nil
+	}
+	// 全部追加完再回调，非指针元素的地址在扩容后才固定
+	for i := start; i < dv.Len(); i++ {
+		ev := dv.Index(i)
+		if !ptr {
+			ev = ev.Addr()
+		}
+		if err := visit(ev); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,396 @@
+package porm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Dialect 屏蔽不同数据库的语法差异
+type Dialect interface {
+	Name() string
+	// Quote 给表名、列名加上引号
+	Quote(identifier string) string
+	// Rebind 把 ? 占位符转换成数据库使用的占位符
+	Rebind(query string) string
+	// Upsert 在 insert 语句后面追加冲突时更新的语句
+	Upsert(query string, conflictColumns, updateColumns []string) (string, error)
+	// InsertIgnore 把 insert 语句转换成忽略冲突的语句
+	InsertIgnore(query string) (string, error)
+	SupportsReturning() bool
+	LimitOffset(limit, offset *int64) string
+	// DataType 返回 go 类型对应的列类型
+	DataType(t reflect.Type) string
+	// IsRetryable 判断是否是死锁、锁等待超时之类重试事务可以解决的错误
+	IsRetryable(err error) bool
+	// MaxPlaceholders 单条语句最多支持的占位符数量，批量插入时按这个数量分批
+	MaxPlaceholders() int
+}
+
+var (
+	MySQL      Dialect = mysqlDialect{}
+	PostgreSQL Dialect = postgresDialect{}
+	SQLite     Dialect = sqliteDialect{}
+)
+
+var (
+	dialectLock sync.RWMutex
+	dialects    = map[string]Dialect{
+		"mysql":    MySQL,
+		"postgres": PostgreSQL,
+		"pgx":      PostgreSQL,
+		"sqlite3":  SQLite,
+		"sqlite":   SQLite,
+	}
+)
+
+// RegisterDialect 注册驱动对应的 Dialect
+func RegisterDialect(driverName string, dialect Dialect) {
+	dialectLock.Lock()
+	defer dialectLock.Unlock()
+
+	dialects[driverName] = dialect
+}
+
+// LookupDialect 返回驱动对应的 Dialect，未注册的驱动默认使用 MySQL
+func LookupDialect(driverName string) Dialect {
+	dialectLock.RLock()
+	defer dialectLock.RUnlock()
+
+	if dialect, ok := dialects[driverName]; ok {
+		return dialect
+	}
+	return MySQL
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string {
+	return "mysql"
+}
+
+func (mysqlDialect) Quote(identifier string) string {
+	return quoteWith(identifier, "`")
+}
+
+func (mysqlDialect) Rebind(query string) string {
+	return query
+}
+
+func (d mysqlDialect) Upsert(query string, conflictColumns, updateColumns []string) (string, error) {
+	if len(updateColumns) == 0 {
+		return "", fmt.Errorf("[porm:mysqlDialect:Upsert]: update columns can not be empty")
+	}
+
+	sets := make([]string, len(updateColumns))
+	for index, column := range updateColumns {
+		column = d.Quote(column)
+		sets[index] = fmt.Sprintf("%s=VALUES(%s)", column, column)
+	}
+	return fmt.Sprintf("%s ON DUPLICATE KEY UPDATE %s", query, strings.Join(sets, ",")), nil
+}
+
+func (mysqlDialect) InsertIgnore(query string) (string, error) {
+	return strings.Replace(query, "INSERT INTO", "INSERT IGNORE INTO", 1), nil
+}
+
+func (mysqlDialect) SupportsReturning() bool {
+	return false
+}
+
+func (mysqlDialect) LimitOffset(limit, offset *int64) string {
+	// mysql 的 OFFSET 必须和 LIMIT 一起使用
+	if limit == nil && offset != nil {
+		return fmt.Sprintf(" LIMIT 18446744073709551615 OFFSET %d", *offset)
+	}
+	return limitOffset(limit, offset)
+}
+
+func (mysqlDialect) DataType(t reflect.Type) string {
+	switch baseType(t) {
+	case reflect.Bool:
+		return "TINYINT(1)"
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return "INT"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return "BIGINT"
+	case reflect.Float32, reflect.Float64:
+		return "DOUBLE"
+	case reflect.String:
+		return "VARCHAR(255)"
+	case reflect.Slice:
+		return "BLOB"
+	case reflect.Struct:
+		return "DATETIME"
+	}
+	return ""
+}
+
+func (mysqlDialect) IsRetryable(err error) bool {
+	var me *mysql.MySQLError
+	if !errors.As(err, &me) {
+		return false
+	}
+	// 1213 死锁，1205 锁等待超时
+	return me.Number == 1213 || me.Number == 1205
+}
+
+func (mysqlDialect) MaxPlaceholders() int {
+	return 65535
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) Quote(identifier string) string {
+	return quoteWith(identifier, `"`)
+}
+
+func (postgresDialect) Rebind(query string) string {
+	var (
+		result strings.Builder
+		quote  rune
+		index  int
+	)
+	for _, ch := range query {
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '?':
+			index++
+			result.WriteString("$")
+			result.WriteString(strconv.Itoa(index))
+			continue
+		}
+		result.WriteRune(ch)
+	}
+	return result.String()
+}
+
+func (d postgresDialect) Upsert(query string, conflictColumns, updateColumns []string) (string, error) {
+	return onConflictUpsert(d, query, conflictColumns, updateColumns)
+}
+
+func (postgresDialect) InsertIgnore(query string) (string, error) {
+	return fmt.Sprintf("%s ON CONFLICT DO NOTHING", query), nil
+}
+
+func (postgresDialect) SupportsReturning() bool {
+	return true
+}
+
+func (postgresDialect) LimitOffset(limit, offset *int64) string {
+	return limitOffset(limit, offset)
+}
+
+func (postgresDialect) DataType(t reflect.Type) string {
+	switch baseType(t) {
+	case reflect.Bool:
+		return "BOOLEAN"
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return "INTEGER"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return "BIGINT"
+	case reflect.Float32, reflect.Float64:
+		return "DOUBLE PRECISION"
+	case reflect.String:
+		return "VARCHAR(255)"
+	case reflect.Slice:
+		return "BYTEA"
+	case reflect.Struct:
+		return "TIMESTAMP"
+	}
+	return ""
+}
+
+// IsRetryable pq 和 pgx 的错误都实现了 SQLState
+func (postgresDialect) IsRetryable(err error) bool {
+	var se interface{ SQLState() string }
+	if !errors.As(err, &se) {
+		return false
+	}
+	// 40001 serialization_failure，40P01 deadlock_detected
+	return se.SQLState() == "40001" || se.SQLState() == "40P01"
+}
+
+func (postgresDialect) MaxPlaceholders() int {
+	return 65535
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) Quote(identifier string) string {
+	return quoteWith(identifier, `"`)
+}
+
+func (sqliteDialect) Rebind(query string) string {
+	return query
+}
+
+func (d sqliteDialect) Upsert(query string, conflictColumns, updateColumns []string) (string, error) {
+	return onConflictUpsert(d, query, conflictColumns, updateColumns)
+}
+
+func (sqliteDialect) InsertIgnore(query string) (string, error) {
+	return fmt.Sprintf("%s ON CONFLICT DO NOTHING", query), nil
+}
+
+func (sqliteDialect) SupportsReturning() bool {
+	return true
+}
+
+func (sqliteDialect) LimitOffset(limit, offset *int64) string {
+	// sqlite 的 OFFSET 必须和 LIMIT 一起使用
+	if limit == nil && offset != nil {
+		return fmt.Sprintf(" LIMIT -1 OFFSET %d", *offset)
+	}
+	return limitOffset(limit, offset)
+}
+
+func (sqliteDialect) DataType(t reflect.Type) string {
+	switch baseType(t) {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "INTEGER"
+	case reflect.Float32, reflect.Float64:
+		return "REAL"
+	case reflect.String:
+		return "TEXT"
+	case reflect.Slice:
+		return "BLOB"
+	case reflect.Struct:
+		return "DATETIME"
+	}
+	return ""
+}
+
+// IsRetryable 不依赖 cgo 的驱动包，按错误信息判断 SQLITE_BUSY 和 SQLITE_LOCKED
+func (sqliteDialect) IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
+
+// MaxPlaceholders SQLITE_MAX_VARIABLE_NUMBER 在 3.32.0 之后默认为 32766
+func (sqliteDialect) MaxPlaceholders() int {
+	return 32766
+}
+
+func onConflictUpsert(d Dialect, query string, conflictColumns, updateColumns []string) (string, error) {
+	if len(conflictColumns) == 0 {
+		return "", fmt.Errorf("[porm:%s:Upsert]: conflict columns can not be empty", d.Name())
+	}
+	if len(updateColumns) == 0 {
+		return "", fmt.Errorf("[porm:%s:Upsert]: update columns can not be empty", d.Name())
+	}
+
+	sets := make([]string, len(updateColumns))
+	for index, column := range updateColumns {
+		column = d.Quote(column)
+		sets[index] = fmt.Sprintf("%s=EXCLUDED.%s", column, column)
+	}
+	return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s", query, strings.Join(quoteColumns(d, conflictColumns), ","), strings.Join(sets, ",")), nil
+}
+
+func limitOffset(limit, offset *int64) string {
+	var result string
+	if limit != nil {
+		result += fmt.Sprintf(" LIMIT %d", *limit)
+	}
+	if offset != nil {
+		result += fmt.Sprintf(" OFFSET %d", *offset)
+	}
+	return result
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	nullTimeType = reflect.TypeOf(Time{})
+)
+
+// baseType 返回类型映射使用的基础类型，Null* 类型按照内部的值处理，时间统一返回 reflect.Struct
+func baseType(t reflect.Type) reflect.Kind {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case timeType, nullTimeType:
+		return reflect.Struct
+	case reflect.TypeOf(NullInt64{}):
+		return reflect.Int64
+	case reflect.TypeOf(NullInt32{}):
+		return reflect.Int32
+	case reflect.TypeOf(NullString{}):
+		return reflect.String
+	case reflect.TypeOf(NullBool{}):
+		return reflect.Bool
+	case reflect.TypeOf(NullFloat64{}):
+		return reflect.Float64
+	}
+
+	if t.Kind() == reflect.Struct || (t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8) {
+		return reflect.Invalid
+	}
+	return t.Kind()
+}
+
+func quoteWith(identifier, quote string) string {
+	parts := strings.Split(identifier, ".")
+	for index, part := range parts {
+		parts[index] = quote + strings.ReplaceAll(part, quote, quote+quote) + quote
+	}
+	return strings.Join(parts, ".")
+}
+
+// quoteIdent dialect 为空时不加引号
+func quoteIdent(d Dialect, identifier string) string {
+	if d == nil {
+		return identifier
+	}
+	return d.Quote(identifier)
+}
+
+func quoteColumns(d Dialect, columns []string) []string {
+	result := make([]string, len(columns))
+	for index, column := range columns {
+		result[index] = quoteIdent(d, column)
+	}
+	return result
+}
+
+func excludeColumns(columns []string, excludes ...[]string) []string {
+	skip := make(map[string]bool)
+	for _, list := range excludes {
+		for _, column := range list {
+			skip[column] = true
+		}
+	}
+
+	var result []string
+	for _, column := range columns {
+		if !skip[column] {
+			result = append(result, column)
+		}
+	}
+	return result
+}
@@ -0,0 +1,148 @@
+package porm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDialectQuote(t *testing.T) {
+	if MySQL.Quote("order") != "`order`" {
+		t.Errorf("mysql quote fail, value = %s", MySQL.Quote("order"))
+	}
+	if PostgreSQL.Quote("a.b") != `"a"."b"` {
+		t.Errorf("postgres quote fail, value = %s", PostgreSQL.Quote("a.b"))
+	}
+	if SQLite.Quote(`a"b`) != `"a""b"` {
+		t.Errorf("sqlite quote fail, value = %s", SQLite.Quote(`a"b`))
+	}
+}
+
+func TestDialectRebind(t *testing.T) {
+	query := "SELECT * FROM author Where name = ? AND bio = '?' AND id IN (?,?)"
+	if MySQL.Rebind(query) != query {
+		t.Errorf("mysql rebind fail, query = %s", MySQL.Rebind(query))
+	}
+
+	expect := "SELECT * FROM author Where name = $1 AND bio = '?' AND id IN ($2,$3)"
+	if PostgreSQL.Rebind(query) != expect {
+		t.Errorf("postgres rebind fail, query = %s", PostgreSQL.Rebind(query))
+	}
+}
+
+func TestDialectLimitOffset(t *testing.T) {
+	limit, offset := int64(10), int64(20)
+
+	if MySQL.LimitOffset(&limit, &offset) != " LIMIT 10 OFFSET 20" {
+		t.Errorf("mysql limit offset fail, value = %s", MySQL.LimitOffset(&limit, &offset))
+	}
+	if MySQL.LimitOffset(nil, &offset) != " LIMIT 18446744073709551615 OFFSET 20" {
+		t.Errorf("mysql offset fail, value = %s", MySQL.LimitOffset(nil, &offset))
+	}
+	if PostgreSQL.LimitOffset(nil, &offset) != " OFFSET 20" {
+		t.Errorf("postgres offset fail, value = %s", PostgreSQL.LimitOffset(nil, &offset))
+	}
+	if SQLite.LimitOffset(nil, &offset) != " LIMIT -1 OFFSET 20" {
+		t.Errorf("sqlite offset fail, value = %s", SQLite.LimitOffset(nil, &offset))
+	}
+	if SQLite.LimitOffset(nil, nil) != "" {
+		t.Errorf("sqlite empty limit offset fail, value = %s", SQLite.LimitOffset(nil, nil))
+	}
+}
+
+func TestDialectUpsert(t *testing.T) {
+	query := "INSERT INTO author (id,name) VALUES (?,?)"
+
+	result, err := MySQL.Upsert(query, nil, []string{"name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "INSERT INTO author (id,name) VALUES (?,?) ON DUPLICATE KEY UPDATE `name`=VALUES(`name`)" {
+		t.Errorf("mysql upsert fail, query = %s", result)
+	}
+
+	result, err = SQLite.Upsert(query, []string{"id"}, []string{"name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != `INSERT INTO author (id,name) VALUES (?,?) ON CONFLICT ("id") DO UPDATE SET "name"=EXCLUDED."name"` {
+		t.Errorf("sqlite upsert fail, query = %s", result)
+	}
+
+	_, err = PostgreSQL.Upsert(query, nil, []string{"name"})
+	if err == nil {
+		t.Errorf("postgres upsert without conflict columns should fail")
+	}
+
+	result, err = MySQL.InsertIgnore(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "INSERT IGNORE INTO author (id,name) VALUES (?,?)" {
+		t.Errorf("mysql insert ignore fail, query = %s", result)
+	}
+
+	result, err = PostgreSQL.InsertIgnore(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "INSERT INTO author (id,name) VALUES (?,?) ON CONFLICT DO NOTHING" {
+		t.Errorf("postgres insert ignore fail, query = %s", result)
+	}
+}
+
+func TestDialectDataType(t *testing.T) {
+	expects := []struct {
+		value   interface{}
+		mysql   string
+		postgre string
+		sqlite  string
+	}{
+		{int64(1), "BIGINT", "BIGINT", "INTEGER"},
+		{"", "VARCHAR(255)", "VARCHAR(255)", "TEXT"},
+		{true, "TINYINT(1)", "BOOLEAN", "INTEGER"},
+		{[]byte{}, "BLOB", "BYTEA", "BLOB"},
+		{time.Time{}, "DATETIME", "TIMESTAMP", "DATETIME"},
+		{NullString{}, "VARCHAR(255)", "VARCHAR(255)", "TEXT"},
+		{Time{}, "DATETIME", "TIMESTAMP", "DATETIME"},
+	}
+
+	for _, expect := range expects {
+		vt := reflect.TypeOf(expect.value)
+		if MySQL.DataType(vt) != expect.mysql || PostgreSQL.DataType(vt) != expect.postgre || SQLite.DataType(vt) != expect.sqlite {
+			t.Errorf("data type fail, type = %s", vt.String())
+		}
+	}
+}
+
+func TestLookupDialect(t *testing.T) {
+	if LookupDialect("pgx") != PostgreSQL || LookupDialect("sqlite3") != SQLite || LookupDialect("unknown") != MySQL {
+		t.Errorf("lookup dialect fail")
+	}
+}
+
+type testSQLStateError string
+
+func (e testSQLStateError) Error() string {
+	return "pg error " + string(e)
+}
+
+func (e testSQLStateError) SQLState() string {
+	return string(e)
+}
+
+func TestDialectIsRetryable(t *testing.T) {
+	if !MySQL.IsRetryable(fmt.Errorf("exec fail: %w", &mysql.MySQLError{Number: 1213})) || MySQL.IsRetryable(&mysql.MySQLError{Number: 1062}) {
+		t.Errorf("mysql retryable fail")
+	}
+	if !PostgreSQL.IsRetryable(testSQLStateError("40001")) || !PostgreSQL.IsRetryable(testSQLStateError("40P01")) || PostgreSQL.IsRetryable(testSQLStateError("23505")) {
+		t.Errorf("postgres retryable fail")
+	}
+	if !SQLite.IsRetryable(errors.New("database is locked")) || SQLite.IsRetryable(errors.New("UNIQUE constraint failed")) {
+		t.Errorf("sqlite retryable fail")
+	}
+}
@@ -2,6 +2,7 @@ package porm
 
 import (
 	"database/sql"
+	"fmt"
 	"time"
 )
 
@@ -9,6 +10,16 @@ const (
 	SqlTimeFormat = "2006-01-02 15:04:05"
 )
 
+// timeFormats 不同数据库以字符串返回时间时使用的格式
+var timeFormats = []string{
+	SqlTimeFormat,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	time.RFC3339Nano,
+	"2006-01-02",
+}
+
 func CoverNullValue(value interface{}) interface{} {
 	if nv, ok := value.(NullValue); ok {
 		return nv.NullInterface()
@@ -128,6 +139,7 @@ type Time struct {
 
 func (t *Time) SetTime(time time.Time) {
 	t.Time = time
+	t.Valid = true
 }
 
 func (t Time) NullInterface() interface{} {
@@ -148,14 +160,35 @@ func (t *Time) Scan(src interface{}) error {
 	}
 	switch st := src.(type) {
 	case []byte:
-		pt, err := time.Parse(SqlTimeFormat, string(st))
+		pt, err := parseTime(string(st))
+		if err != nil {
+			return err
+		}
+		t.Time = pt
+	case string:
+		pt, err := parseTime(st)
 		if err != nil {
 			return err
 		}
 		t.Time = pt
 	case time.Time:
 		t.Time = st
+	default:
+		return fmt.Errorf("[porm:Time:Scan]: unsupported type %T", src)
 	}
+	t.Valid = true
 
 	return nil
 }
+
+func parseTime(value string) (time.Time, error) {
+	var err error
+	for _, format := range timeFormats {
+		var pt time.Time
+		pt, err = time.Parse(format, value)
+		if err == nil {
+			return pt, nil
+		}
+	}
+	return time.Time{}, err
+}
@@ -0,0 +1,59 @@
+package porm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/yongpi/putil/psql"
+)
+
+// Find 按 st 查询并返回 T 的列表，T 一般为 *Model
+func Find[T Model](ctx context.Context, o *orm, st *psql.SelectStatement) ([]T, error) {
+	if st == nil {
+		return nil, fmt.Errorf("[porm:Find]: st can not be nil")
+	}
+
+	// 复制一份语句，Select 会填充列名和表名，不修改调用方的语句
+	cst := *st
+	cst.Columns = append([]string(nil), st.Columns...)
+
+	var list []T
+	err := o.WithStatement(&cst).Select(ctx, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// First 返回第一条记录，没有记录时返回 sql.ErrNoRows
+func First[T Model](ctx context.Context, o *orm, st *psql.SelectStatement) (T, error) {
+	var zero T
+	if st == nil {
+		return zero, fmt.Errorf("[porm:First]: st can not be nil")
+	}
+
+	// 复制一份语句再设置 LIMIT，不修改调用方的语句
+	cst := *st
+	list, err := Find[T](ctx, o, cst.Limit(1))
+	if err != nil {
+		return zero, err
+	}
+	if len(list) == 0 {
+		return zero, sql.ErrNoRows
+	}
+
+	return list[0], nil
+}
+
+// Get 按主键查询，pk 的格式同 BuildPKCond，没有记录时返回 sql.ErrNoRows
+func Get[T Model](ctx context.Context, o *orm, pk interface{}) (T, error) {
+	var zero T
+	cond, err := o.pkCond([]T{}, pk)
+	if err != nil {
+		return zero, err
+	}
+
+	return First[T](ctx, o, psql.Select("*").Where(cond))
+}
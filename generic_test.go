@@ -0,0 +1,92 @@
+package porm
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"github.com/yongpi/putil/psql"
+)
+
+func TestFind(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	st := psql.Select("*").OrderBy("id DESC")
+	list, err := Find[*TestAuthorM](ctx, o, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "b" || list[1].Name != "a" {
+		t.Errorf("find fail, list = %+v", list)
+	}
+
+	// 不修改调用方的语句，同一个语句可以查询其它的 model
+	if !reflect.DeepEqual(st.Columns, []string{"*"}) || st.TableName != "" {
+		t.Errorf("find should not fill st, columns = %v, table = %s", st.Columns, st.TableName)
+	}
+	if _, err = Find[*TestOrderM](ctx, o, st); err != nil {
+		t.Errorf("find other model with same st fail, err = %v", err)
+	}
+
+	list, err = Find[*TestAuthorM](ctx, o, psql.Select("*").Where(psql.Eq{"name": "not exist"}))
+	if err != nil || len(list) != 0 {
+		t.Errorf("find nothing should return empty list, list = %+v, err = %v", list, err)
+	}
+
+	if _, err = Find[*TestAuthorM](ctx, o, nil); err == nil {
+		t.Errorf("find with nil statement should fail")
+	}
+}
+
+func TestFirst(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	st := psql.Select("*").OrderBy("id DESC")
+	m, err := First[*TestAuthorM](ctx, o, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "b" {
+		t.Errorf("first fail, m = %+v", m)
+	}
+
+	// 不修改调用方的语句
+	if st.LimitValue != nil {
+		t.Errorf("first should not set limit of st, limit = %d", *st.LimitValue)
+	}
+	if !reflect.DeepEqual(st.Columns, []string{"*"}) || st.TableName != "" {
+		t.Errorf("first should not fill st, columns = %v, table = %s", st.Columns, st.TableName)
+	}
+	list, err := Find[*TestAuthorM](ctx, o, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("find after first fail, size = %d", len(list))
+	}
+
+	_, err = First[*TestAuthorM](ctx, o, psql.Select("*").Where(psql.Eq{"name": "not exist"}))
+	if err != sql.ErrNoRows {
+		t.Errorf("first nothing should return sql.ErrNoRows, err = %v", err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	m, err := Get[*TestAuthorM](ctx, o, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 2 || m.Name != "b" {
+		t.Errorf("get fail, m = %+v", m)
+	}
+
+	if _, err = Get[*TestAuthorM](ctx, o, 100); err != sql.ErrNoRows {
+		t.Errorf("get not exist should return sql.ErrNoRows, err = %v", err)
+	}
+}
@@ -1,8 +1,9 @@
 module github.com/yongpi/porm
 
-go 1.14
+go 1.21
 
 require (
 	github.com/go-sql-driver/mysql v1.6.0
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/yongpi/putil v0.0.8
 )
@@ -0,0 +1,203 @@
+package porm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yongpi/putil/plog"
+)
+
+const (
+	defaultHealthInterval = 5 * time.Second
+	defaultHealthTimeout  = time.Second
+)
+
+// HealthCheckConfig 从库的健康检查配置
+type HealthCheckConfig struct {
+	// Interval 检查间隔，默认 5s
+	Interval time.Duration
+	// Timeout 每次检查的超时时间，默认 1s
+	Timeout time.Duration
+	// FailThreshold 连续失败多少次后剔除，默认 1
+	FailThreshold int
+	// RecoverThreshold 剔除后连续成功多少次后恢复，默认 1
+	RecoverThreshold int
+	// Check 检查方法，默认使用 ping
+	Check func(ctx context.Context, db *DB) error
+	// MaxLag 大于 0 时检查从库的复制延迟，延迟超过 MaxLag 或者检查失败的从库不再读
+	MaxLag time.Duration
+	// LagProbe 测量延迟的方法，默认根据方言选择，支持 mysql 和 postgres
+	LagProbe LagProbe
+}
+
+func (c HealthCheckConfig) withDefault() HealthCheckConfig {
+	if c.Interval <= 0 {
+		c.Interval = defaultHealthInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultHealthTimeout
+	}
+	if c.FailThreshold <= 0 {
+		c.FailThreshold = 1
+	}
+	if c.RecoverThreshold <= 0 {
+		c.RecoverThreshold = 1
+	}
+	if c.Check == nil {
+		c.Check = func(ctx context.Context, db *DB) error {
+			return db.PingContext(ctx)
+		}
+	}
+	return c
+}
+
+// ReplicaStatus 从库的健康状态
+type ReplicaStatus struct {
+	// Index 从库在 DBConfigs 中的下标，主库为 0
+	Index   int
+	Healthy bool
+	// Failures、Successes 连续失败、成功的次数
+	Failures  int
+	Successes int
+	LastError error
+	CheckedAt time.Time
+	// Lag 最近一次检查的复制延迟，Lagging 为 true 时不再读
+	Lag      time.Duration
+	Lagging  bool
+	LagError error
+}
+
+type replica struct {
+	*SimpleStorage
+	weight int
+	// healthy、lagging、inFlight、latency 读请求时使用，不需要加锁
+	healthy  int32
+	lagging  int32
+	inFlight int64
+	latency  int64
+	mu       sync.Mutex
+	status   ReplicaStatus
+}
+
+func newReplica(storage *SimpleStorage, index int, weight int) *replica {
+	return &replica{SimpleStorage: storage, weight: weight, healthy: 1, status: ReplicaStatus{Index: index, Healthy: true}}
+}
+
+// available 健康并且延迟没有超过限制的从库可以读
+func (r *replica) available() bool {
+	return atomic.LoadInt32(&r.healthy) == 1 && atomic.LoadInt32(&r.lagging) == 0
+}
+
+// report 记录一次检查结果，连续失败或者成功达到阈值时剔除或者恢复
+func (r *replica) report(err error, config HealthCheckConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status.CheckedAt = time.Now()
+	r.status.LastError = err
+	if err != nil {
+		r.status.Failures++
+		r.status.Successes = 0
+		if r.status.Healthy && r.status.Failures >= config.FailThreshold {
+			r.status.Healthy = false
+			atomic.StoreInt32(&r.healthy, 0)
+			plog.WithError(err).Errorf("[porm:replica]: eject replica, db = %s, index = %d", r.Name, r.status.Index)
+		}
+		return
+	}
+
+	r.status.Successes++
+	r.status.Failures = 0
+	if !r.status.Healthy && r.status.Successes >= config.RecoverThreshold {
+		r.status.Healthy = true
+		atomic.StoreInt32(&r.healthy, 1)
+		plog.Infof("[porm:replica]: recover replica, db = %s, index = %d", r.Name, r.status.Index)
+	}
+}
+
+func (r *replica) snapshot() ReplicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// CheckHealth 检查一次所有从库，配置了 MaxLag 时同时检查健康从库的延迟，等待所有检查结束后返回
+func (s *MasterSlaveStorage) CheckHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, slave := range s.slaves {
+		wg.Add(1)
+		go func(slave *replica) {
+			defer wg.Done()
+
+			cctx, cancel := context.WithTimeout(ctx, s.healthConfig.Timeout)
+			defer cancel()
+			err := s.healthConfig.Check(cctx, slave.db)
+			slave.report(err, s.healthConfig)
+			if err != nil || s.healthConfig.MaxLag <= 0 {
+				return
+			}
+
+			lctx, cancel := context.WithTimeout(ctx, s.healthConfig.Timeout)
+			defer cancel()
+			lag, err := s.healthConfig.LagProbe.Lag(lctx, slave.db)
+			slave.reportLag(lag, err, s.healthConfig.MaxLag)
+		}(slave)
+	}
+	wg.Wait()
+}
+
+// Health 返回所有从库的健康状态
+func (s *MasterSlaveStorage) Health() []ReplicaStatus {
+	list := make([]ReplicaStatus, 0, len(s.slaves))
+	for _, slave := range s.slaves {
+		list = append(list, slave.snapshot())
+	}
+	return list
+}
+
+// StopHealthCheck 停止后台的健康检查，从库保持停止时的状态
+func (s *MasterSlaveStorage) StopHealthCheck() {
+	s.stopOnce.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+		}
+	})
+}
+
+func (s *MasterSlaveStorage) startHealthCheck() {
+	if len(s.slaves) == 0 {
+		return
+	}
+
+	s.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.healthConfig.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.CheckHealth(context.Background())
+			}
+		}
+	}()
+}
+
+// StorageHealth 返回指定 storage 的从库健康状态
+func StorageHealth(storageName string) ([]ReplicaStatus, error) {
+	storage := lookupStorage(storageName)
+	if storage == nil {
+		return nil, fmt.Errorf("[porm:StorageHealth]: storage not found, storage = %s", storageName)
+	}
+
+	ms, ok := storage.(*MasterSlaveStorage)
+	if !ok {
+		return nil, fmt.Errorf("[porm:StorageHealth]: storage is not master slave storage, storage = %s", storageName)
+	}
+	return ms.Health(), nil
+}
@@ -1,6 +1,13 @@
 package porm
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/yongpi/putil/plog"
+)
 
 type HookType int
 
@@ -13,68 +20,240 @@ const (
 	AfterSelect
 	BeforeDelete
 	AfterDelete
+	// BeforeTxRetry 事务重试前执行，通过 TxRetryFromContext 获取重试信息，hook 调用 Abort 时不再重试
+	BeforeTxRetry
+	// BeforeBegin 开启数据库事务前执行，hook 调用 Abort 时不开启事务；加入已有事务时不执行
+	BeforeBegin
+	// AfterCommit、AfterRollback 最外层事务结束后执行，提交失败时执行 AfterRollback，hook 调用 Abort 的错误会被忽略
+	AfterCommit
+	AfterRollback
+	// BeforeExec、AfterExec 每次执行 sql 时执行，包括事务中的 SAVEPOINT 等语句，通过 OperationFromContext 获取 sql 和执行结果；
+	// BeforeExec 调用 Abort 时不执行 sql，AfterExec 调用 Abort 的错误作为执行的错误
+	BeforeExec
+	AfterExec
 )
 
 type Hook func(ctx context.Context, orm *orm)
 
-var Hooks map[HookType][]Hook
+// after After 类的 hook 按照 session、storage、全局的顺序执行，其它的按照全局、storage、session 的顺序执行
+func (t HookType) after() bool {
+	switch t {
+	case AfterInsert, AfterUpdate, AfterSelect, AfterDelete, AfterCommit, AfterRollback, AfterExec:
+		return true
+	}
+	return false
+}
+
+// HookID 注册 hook 时返回，用于删除 hook
+type HookID uint64
 
-func InjectHook(hook Hook, hookType HookType) {
-	list := Hooks[hookType]
-	list = append(list, hook)
-	Hooks[hookType] = list
+var (
+	hookSeq uint64
+	// hookOwners 记录 hook 所在的注册表，RemoveHook 时使用
+	hookOwners  sync.Map
+	globalHooks = NewHookRegistry()
+)
+
+type hookEntry struct {
+	id   HookID
+	hook Hook
 }
 
-func init() {
-	Hooks = make(map[HookType][]Hook)
+// HookRegistry 线程安全的 hook 注册表
+type HookRegistry struct {
+	mu           sync.RWMutex
+	hooks        map[HookType][]hookEntry
+	interceptors []interceptorEntry
 }
 
-func Fishing(ctx context.Context, hookType HookType, o *orm) {
-	hooks, ok := Hooks[hookType]
-	if !ok {
-		return
+func NewHookRegistry() *HookRegistry {
+	return &HookRegistry{hooks: make(map[HookType][]hookEntry)}
+}
+
+func (r *HookRegistry) Add(hook Hook, hookType HookType) HookID {
+	id := HookID(atomic.AddUint64(&hookSeq, 1))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.hooks[hookType] = append(r.hooks[hookType], hookEntry{id: id, hook: hook})
+	hookOwners.Store(id, r)
+	return id
+}
+
+func (r *HookRegistry) AddInterceptor(interceptor Interceptor) HookID {
+	id := HookID(atomic.AddUint64(&hookSeq, 1))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.interceptors = append(r.interceptors, interceptorEntry{id: id, interceptor: interceptor})
+	hookOwners.Store(id, r)
+	return id
+}
+
+func (r *HookRegistry) Remove(id HookID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for index, entry := range r.interceptors {
+		if entry.id == id {
+			list := make([]interceptorEntry, 0, len(r.interceptors)-1)
+			list = append(list, r.interceptors[:index]...)
+			r.interceptors = append(list, r.interceptors[index+1:]...)
+			hookOwners.Delete(id)
+			return true
+		}
 	}
 
-	for _, hook := range hooks {
-		hook(ctx, o)
-		if o.err != nil {
-			return
+	for hookType, entries := range r.hooks {
+		for index, entry := range entries {
+			if entry.id != id {
+				continue
+			}
+
+			// 复制一份，不影响正在执行的 hook 列表
+			list := make([]hookEntry, 0, len(entries)-1)
+			list = append(list, entries[:index]...)
+			r.hooks[hookType] = append(list, entries[index+1:]...)
+			hookOwners.Delete(id)
+			return true
 		}
 	}
+	return false
+}
 
-	return
+func (r *HookRegistry) interceptorList() []interceptorEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.interceptors
+}
+
+func (r *HookRegistry) list(hookType HookType) []hookEntry {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.hooks[hookType]
+}
+
+// HookStorage 支持注册 hook 的 Storage
+type HookStorage interface {
+	Hooks() *HookRegistry
+}
+
+// InjectHook 注册全局的 hook，对所有 storage 生效
+func InjectHook(hook Hook, hookType HookType) HookID {
+	return globalHooks.Add(hook, hookType)
+}
+
+// InjectStorageHook 注册只对指定 storage 生效的 hook
+func InjectStorageHook(storageName string, hook Hook, hookType HookType) (HookID, error) {
+	storage := lookupStorage(storageName)
+	if storage == nil {
+		return 0, fmt.Errorf("[porm:InjectStorageHook]: storage not found, storage = %s", storageName)
+	}
+
+	hs, ok := storage.(HookStorage)
+	if !ok {
+		return 0, fmt.Errorf("[porm:InjectStorageHook]: storage not support hook, storage = %s", storageName)
+	}
+	return hs.Hooks().Add(hook, hookType), nil
+}
+
+// RemoveHook 删除全局或者 storage 的 hook 和拦截器
+func RemoveHook(id HookID) bool {
+	owner, ok := hookOwners.Load(id)
+	if !ok {
+		return false
+	}
+	return owner.(*HookRegistry).Remove(id)
+}
+
+// Abort 在 hook 中调用，中止当前的操作并返回 err，后面的 hook 不再执行
+func (o *orm) Abort(err error) {
+	o.err = err
+}
+
+func Fishing(ctx context.Context, hookType HookType, o *orm) {
+	var storageHooks *HookRegistry
+	if hs, ok := o.storage.(HookStorage); ok {
+		storageHooks = hs.Hooks()
+	}
+
+	levels := [][]hookEntry{globalHooks.list(hookType), storageHooks.list(hookType), o.hooks[hookType]}
+	if hookType.after() {
+		levels[0], levels[2] = levels[2], levels[0]
+	}
+
+	for _, entries := range levels {
+		for _, entry := range entries {
+			entry.hook(ctx, o)
+			if o.err != nil {
+				return
+			}
+		}
+	}
 }
 
 type TxHook struct {
 }
 
 func (t *TxHook) BeginTxHook(ctx context.Context, orm *orm) {
-	no, err := orm.BeginTx(ctx)
+	no, err := orm.statementTx(ctx)
 	if err != nil {
 		orm.err = err
 		return
 	}
 
 	orm.Copy(no)
+	orm.stmtTx = true
 	return
 }
 
+// EndTxHook 结束 BeginTxHook 为当前语句开启或者加入的事务，出错时回滚；由 fishAfter 在所有 After hook 之后执行
 func (t *TxHook) EndTxHook(ctx context.Context, orm *orm) {
+	if !orm.stmtTx {
+		return
+	}
+
+	orm.stmtTx = false
 	if orm.err == nil {
 		orm.err = orm.Commit()
 		return
 	}
 
-	orm.err = orm.Rollback()
-	return
+	if err := orm.Rollback(); err != nil {
+		plog.WithError(err).Errorf("[porm:TxHook:EndTxHook]: rollback tx fail, db = %s", orm.StorageName())
+	}
+}
+
+// fishAfter 执行写操作的 After hook，最后结束当前语句的事务：语句失败或者 hook 中止时 Fishing 会提前返回，事务也要结束
+func (o *orm) fishAfter(ctx context.Context, hookType HookType) error {
+	Fishing(ctx, hookType, o)
+	txHook.EndTxHook(ctx, o)
+	return o.err
+}
+
+// abortStatement Before 类的 hook 中止时 After hook 不会执行，回滚 TxHook 已经为当前语句开启的事务
+func (o *orm) abortStatement() error {
+	txHook.EndTxHook(context.Background(), o)
+	return o.err
 }
 
 type SelectHook struct {
 }
 
 func (t *SelectHook) BeforeHook(ctx context.Context, orm *orm) {
-	no := TxORMFromContext(ctx)
-	if no == nil {
+	// 自身已经在事务中时不使用 context 中的事务
+	if orm.tx.live() != nil {
+		return
+	}
+
+	no := StorageTxORMFromContext(ctx, orm.StorageName())
+	if no == nil || !orm.sameShardDB(no.tx) {
 		return
 	}
 
@@ -82,18 +261,15 @@ func (t *SelectHook) BeforeHook(ctx context.Context, orm *orm) {
 	return
 }
 
+// txHook EndTxHook 不注册为 hook，After hook 的顺序和 session、storage 的 hook 提前返回都不影响事务的结束
+var txHook = &TxHook{}
+
 func init() {
-	txHook := &TxHook{}
 	selectHook := &SelectHook{}
 
 	InjectHook(selectHook.BeforeHook, BeforeSelect)
 
 	InjectHook(txHook.BeginTxHook, BeforeInsert)
-	InjectHook(txHook.EndTxHook, AfterInsert)
-
 	InjectHook(txHook.BeginTxHook, BeforeDelete)
-	InjectHook(txHook.EndTxHook, AfterDelete)
-
 	InjectHook(txHook.BeginTxHook, BeforeUpdate)
-	InjectHook(txHook.EndTxHook, AfterUpdate)
 }
@@ -0,0 +1,183 @@
+package porm
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/yongpi/putil/psql"
+)
+
+func TestHookOrder(t *testing.T) {
+	ctx := context.Background()
+
+	var calls []string
+	record := func(name string) Hook {
+		return func(ctx context.Context, o *orm) {
+			calls = append(calls, name)
+		}
+	}
+
+	var ids []HookID
+	for _, hookType := range []HookType{BeforeSelect, AfterSelect} {
+		ids = append(ids, InjectHook(record("global"), hookType))
+
+		id, err := InjectStorageHook(sqliteStorageName, record("storage"), hookType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	defer func() {
+		for _, id := range ids {
+			RemoveHook(id)
+		}
+	}()
+
+	o := NORM(sqliteStorageName).WithHook(record("session"), BeforeSelect).WithHook(record("session"), AfterSelect)
+	Fishing(ctx, BeforeSelect, o.session())
+	Fishing(ctx, AfterSelect, o.session())
+	if !reflect.DeepEqual(calls, []string{"global", "storage", "session", "session", "storage", "global"}) {
+		t.Errorf("hook order fail, calls = %v", calls)
+	}
+
+	// storage 和 session 的 hook 不影响其它 orm
+	calls = nil
+	Fishing(ctx, BeforeSelect, NORM(billingStorageName))
+	if !reflect.DeepEqual(calls, []string{"global"}) {
+		t.Errorf("storage hook should only apply to its storage, calls = %v", calls)
+	}
+
+	calls = nil
+	if !RemoveHook(ids[0]) || RemoveHook(ids[0]) {
+		t.Errorf("remove hook fail")
+	}
+	Fishing(ctx, BeforeSelect, NORM(sqliteStorageName))
+	if !reflect.DeepEqual(calls, []string{"storage"}) {
+		t.Errorf("removed hook should not run, calls = %v", calls)
+	}
+
+	_, err := InjectStorageHook("not_exist", record("storage"), BeforeSelect)
+	if err == nil {
+		t.Errorf("inject hook to not exist storage should fail")
+	}
+}
+
+func TestHookConcurrent(t *testing.T) {
+	ctx := context.Background()
+	o := NORM(sqliteStorageName)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			id := InjectHook(func(ctx context.Context, o *orm) {}, BeforeTxRetry)
+			RemoveHook(id)
+		}()
+		go func() {
+			defer wg.Done()
+			Fishing(ctx, BeforeTxRetry, o.session())
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHookTxLifecycle(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	var calls []string
+	record := func(name string) Hook {
+		return func(ctx context.Context, o *orm) {
+			calls = append(calls, name)
+		}
+	}
+	no := o.WithHook(record("begin"), BeforeBegin).WithHook(record("commit"), AfterCommit).WithHook(record("rollback"), AfterRollback)
+
+	// 加入已有事务和 savepoint 不执行
+	err := no.Transaction(ctx, func(ctx context.Context, to *orm) error {
+		return no.Transaction(ctx, func(ctx context.Context, to *orm) error {
+			_, err := to.Insert(ctx, &TestAuthorM{Name: "c"})
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"begin", "commit"}) {
+		t.Errorf("commit hook fail, calls = %v", calls)
+	}
+
+	calls = nil
+	stop := errors.New("stop")
+	err = no.Transaction(ctx, func(ctx context.Context, to *orm) error {
+		return stop
+	})
+	if !errors.Is(err, stop) || !reflect.DeepEqual(calls, []string{"begin", "rollback"}) {
+		t.Errorf("rollback hook fail, err = %v, calls = %v", err, calls)
+	}
+
+	// 单条语句的事务也执行
+	calls = nil
+	if _, err = no.Insert(ctx, &TestAuthorM{Name: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"begin", "commit"}) {
+		t.Errorf("statement tx hook fail, calls = %v", calls)
+	}
+
+	// BeforeBegin 调用 Abort 时不开启事务
+	err = o.WithHook(func(ctx context.Context, o *orm) { o.Abort(stop) }, BeforeBegin).Transaction(ctx, func(ctx context.Context, to *orm) error {
+		t.Error("tx should not begin")
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("before begin hook error fail, err = %v", err)
+	}
+}
+
+func TestHookExec(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	var ops []Operation
+	no := o.WithHook(func(ctx context.Context, o *orm) {
+		if op := OperationFromContext(ctx); op == nil || op.Query == "" || !op.Start.IsZero() {
+			t.Errorf("before exec operation fail, op = %+v", op)
+		}
+	}, BeforeExec).WithHook(func(ctx context.Context, o *orm) {
+		ops = append(ops, *OperationFromContext(ctx))
+	}, AfterExec)
+
+	if _, err := no.Insert(ctx, &TestAuthorM{Name: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	if err := no.WithStatement(psql.Select("*")).SelectWithCount(ctx, &[]*TestAuthorM{}, &count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || len(ops) != 3 {
+		t.Fatalf("exec hook fail, count = %d, ops = %+v", count, ops)
+	}
+	for index, action := range []SqlAction{Insert, Select, Select} {
+		if ops[index].Action != action || ops[index].Table != "author" || ops[index].End.IsZero() {
+			t.Errorf("exec hook operation fail, op = %+v", ops[index])
+		}
+	}
+	if ops[0].RowsAffected != 1 {
+		t.Errorf("exec hook rows affected fail, op = %+v", ops[0])
+	}
+
+	// BeforeExec 调用 Abort 时不执行 sql
+	stop := errors.New("stop")
+	_, err := o.WithHook(func(ctx context.Context, o *orm) { o.Abort(stop) }, BeforeExec).DeleteX(ctx, "DELETE FROM author")
+	if !errors.Is(err, stop) {
+		t.Errorf("before exec hook error fail, err = %v", err)
+	}
+	if list, _ := Find[*TestAuthorM](ctx, o, psql.Select("*")); len(list) != 3 {
+		t.Errorf("sql should not execute, list = %+v", list)
+	}
+}
@@ -0,0 +1,175 @@
+package porm
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Operation 一次 sql 执行的信息，拦截器调用 next 前可以修改 Query 和 Args
+type Operation struct {
+	Action  SqlAction
+	Storage string
+	// Table 从 model 中获取的表名，直接执行 sql 时为空
+	Table string
+	Query string
+	Args  []interface{}
+	// Start、End 为 sql 实际执行的时间
+	Start time.Time
+	End   time.Time
+	// RowsAffected 写操作影响的行数
+	RowsAffected int64
+	Err          error
+}
+
+// Interceptor 拦截 sql 的执行，必须调用 next 才会继续执行，next 返回后可以读取执行结果
+type Interceptor func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error
+
+type interceptorEntry struct {
+	id          HookID
+	interceptor Interceptor
+}
+
+// UseInterceptor 注册全局的拦截器，返回的 HookID 可以通过 RemoveHook 删除
+func UseInterceptor(interceptor Interceptor) HookID {
+	return globalHooks.AddInterceptor(interceptor)
+}
+
+// UseStorageInterceptor 注册只对指定 storage 生效的拦截器
+func UseStorageInterceptor(storageName string, interceptor Interceptor) (HookID, error) {
+	storage := lookupStorage(storageName)
+	if storage == nil {
+		return 0, fmt.Errorf("[porm:UseStorageInterceptor]: storage not found, storage = %s", storageName)
+	}
+
+	hs, ok := storage.(HookStorage)
+	if !ok {
+		return 0, fmt.Errorf("[porm:UseStorageInterceptor]: storage not support hook, storage = %s", storageName)
+	}
+	return hs.Hooks().AddInterceptor(interceptor), nil
+}
+
+// WithInterceptor 返回带有拦截器的 orm，拦截器只对返回的 orm 生效
+func (o *orm) WithInterceptor(interceptor Interceptor) *orm {
+	no := o.session()
+	no.interceptors = append(append([]interceptorEntry(nil), o.interceptors...), interceptorEntry{interceptor: interceptor})
+	return no
+}
+
+// withTable 返回记录了表名的副本，表名只用于拦截器中的 Operation
+func (o *orm) withTable(table string) *orm {
+	no := o.session()
+	no.table = table
+	return no
+}
+
+// withModelTable 同 withTable，表名从 model 中获取，获取不到时为空
+func (o *orm) withModelTable(model interface{}) *orm {
+	table, _ := PickUpTable(model)
+	return o.withTable(table)
+}
+
+// intercept 按照全局、storage、session 的顺序执行拦截器，最后执行 BeforeExec hook、fun、AfterExec hook
+func (o *orm) intercept(ctx context.Context, op *Operation, fun func(ctx context.Context, op *Operation) error) error {
+	// context 中写过的 storage 读主库
+	rw := readYourWritesFrom(ctx)
+	if rw != nil && o.sqlAction == Select && rw.sticky(o.StorageName(), o.stickyWindow()) {
+		o.forceMaster = true
+	}
+
+	if err := o.routeShard(op); err != nil {
+		o.err = err
+		return err
+	}
+
+	err := o.interceptChain(ctx, op, o.tracked(fun))
+	if rw != nil && err == nil && o.sqlAction != Select {
+		rw.wrote(o.StorageName())
+	}
+	return err
+}
+
+// tracked 执行前确定本次使用的 db，storage 可以记录每个 db 的执行情况，用于负载均衡
+func (o *orm) tracked(fun func(ctx context.Context, op *Operation) error) func(ctx context.Context, op *Operation) error {
+	ts, ok := o.storage.(trackedStorage)
+	if !ok {
+		return fun
+	}
+
+	return func(ctx context.Context, op *Operation) error {
+		// 事务中的语句使用事务所在的连接
+		if o.tx.live() != nil {
+			return fun(ctx, op)
+		}
+
+		db, done := ts.track(o)
+		o.db = db
+		err := fun(ctx, op)
+		o.db = nil
+		done(err)
+		return err
+	}
+}
+
+func (o *orm) interceptChain(ctx context.Context, op *Operation, fun func(ctx context.Context, op *Operation) error) error {
+	op.Action = o.sqlAction
+	op.Storage = o.StorageName()
+	op.Table = o.table
+
+	chain := globalHooks.interceptorList()
+	if hs, ok := o.storage.(HookStorage); ok {
+		chain = append(chain[:len(chain):len(chain)], hs.Hooks().interceptorList()...)
+	}
+	chain = append(chain[:len(chain):len(chain)], o.interceptors...)
+
+	return runInterceptors(ctx, chain, op, func(ctx context.Context, op *Operation) error {
+		ctx = withOperation(ctx, op)
+		Fishing(ctx, BeforeExec, o)
+		if o.err != nil {
+			return o.err
+		}
+
+		op.Start = time.Now()
+		op.Err = fun(ctx, op)
+		op.End = time.Now()
+
+		// AfterExec 通过 OperationFromContext 获取执行结果，hook 调用 Abort 的错误作为执行的错误
+		Fishing(ctx, AfterExec, o)
+		if op.Err == nil {
+			op.Err = o.err
+		}
+		return op.Err
+	})
+}
+
+func runInterceptors(ctx context.Context, chain []interceptorEntry, op *Operation, fun func(ctx context.Context, op *Operation) error) error {
+	var call func(ctx context.Context, index int) error
+	call = func(ctx context.Context, index int) error {
+		if index < len(chain) {
+			return chain[index].interceptor(ctx, op, func(ctx context.Context) error {
+				return call(ctx, index+1)
+			})
+		}
+		return fun(ctx, op)
+	}
+
+	err := call(ctx, 0)
+	op.Err = err
+	return err
+}
+
+// interceptDB 直接通过 DB、Conn、Tx、Stmt 查询时执行拦截器，storage 已经注册时和 orm 一样执行 storage 的拦截器和 exec hook
+func interceptDB(ctx context.Context, name string, op *Operation, fun func(ctx context.Context, op *Operation) error) error {
+	if storage := lookupStorage(name); storage != nil {
+		return (&orm{storage: storage, sqlAction: Select}).interceptChain(ctx, op, fun)
+	}
+
+	op.Action = Select
+	op.Storage = name
+	return runInterceptors(ctx, globalHooks.interceptorList(), op, func(ctx context.Context, op *Operation) error {
+		op.Start = time.Now()
+		err := fun(ctx, op)
+		op.End = time.Now()
+		return err
+	})
+}
@@ -0,0 +1,236 @@
+package porm
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/yongpi/putil/psql"
+)
+
+func TestInterceptor(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	var ops []Operation
+	record := func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error {
+		err := next(ctx)
+		ops = append(ops, *op)
+		return err
+	}
+	// 只查询 name = 'b' 的数据，模拟租户过滤
+	tenant := func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error {
+		if op.Action == Select && op.Table == "author" {
+			op.Query = "SELECT * FROM (" + op.Query + ") t WHERE name = ?"
+			op.Args = append(op.Args, "b")
+		}
+		return next(ctx)
+	}
+
+	no := o.WithInterceptor(record).WithInterceptor(tenant)
+	list, err := Find[*TestAuthorM](ctx, no, psql.Select("*").OrderBy("id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "b" {
+		t.Fatalf("rewrite query fail, list = %+v", list)
+	}
+
+	_, err = no.WithStatement(psql.Update("").Set("bio", "new bio").Where(psql.Eq{"id": list[0].ID})).Update(ctx, &TestAuthorM{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = no.Insert(ctx, &TestAuthorM{Name: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = no.DeleteX(ctx, "DELETE FROM not_exist")
+	if err == nil {
+		t.Fatal("delete from not exist table should fail")
+	}
+
+	if len(ops) != 4 {
+		t.Fatalf("intercept count fail, ops = %+v", ops)
+	}
+	for index, action := range []SqlAction{Select, Update, Insert, Delete} {
+		op := ops[index]
+		if op.Action != action || op.Storage != sqliteStorageName || op.Start.IsZero() || op.End.Before(op.Start) {
+			t.Errorf("operation fail, op = %+v", op)
+		}
+	}
+	if ops[0].Table != "author" || !reflect.DeepEqual(ops[0].Args, []interface{}{"b"}) {
+		t.Errorf("select operation fail, op = %+v", ops[0])
+	}
+	if ops[1].Table != "author" || ops[1].RowsAffected != 1 {
+		t.Errorf("update operation fail, op = %+v", ops[1])
+	}
+	if ops[2].Table != "author" || ops[2].RowsAffected != 1 {
+		t.Errorf("insert operation fail, op = %+v", ops[2])
+	}
+	if ops[3].Table != "" || ops[3].Err == nil {
+		t.Errorf("delete operation fail, op = %+v", ops[3])
+	}
+
+	// session 的拦截器不影响原来的 orm
+	ops = nil
+	if _, err = Find[*TestAuthorM](ctx, o, psql.Select("*")); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 0 {
+		t.Errorf("session interceptor should not apply to parent, ops = %+v", ops)
+	}
+}
+
+func TestInterceptorOrder(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	var calls []string
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error {
+			calls = append(calls, name)
+			err := next(ctx)
+			calls = append(calls, name)
+			return err
+		}
+	}
+
+	globalID := UseInterceptor(record("global"))
+	defer RemoveHook(globalID)
+	storageID, err := UseStorageInterceptor(sqliteStorageName, record("storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveHook(storageID)
+
+	if _, err = Find[*TestAuthorM](ctx, o.WithInterceptor(record("session")), psql.Select("*")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"global", "storage", "session", "session", "storage", "global"}) {
+		t.Errorf("interceptor order fail, calls = %v", calls)
+	}
+
+	// 拦截器返回错误时不执行 sql
+	stop := errors.New("stop")
+	_, err = o.WithInterceptor(func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error {
+		return stop
+	}).DeleteX(ctx, "DELETE FROM author")
+	if !errors.Is(err, stop) {
+		t.Errorf("interceptor error fail, err = %v", err)
+	}
+	if list, _ := Find[*TestAuthorM](ctx, o, psql.Select("*")); len(list) != 2 {
+		t.Errorf("sql should not execute, list = %+v", list)
+	}
+
+	calls = nil
+	if !RemoveHook(globalID) || !RemoveHook(storageID) || RemoveHook(globalID) {
+		t.Errorf("remove interceptor fail")
+	}
+	if _, err = Find[*TestAuthorM](ctx, o, psql.Select("*")); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("removed interceptor should not run, calls = %v", calls)
+	}
+
+	_, err = UseStorageInterceptor("not_exist", record("storage"))
+	if err == nil {
+		t.Errorf("use interceptor on not exist storage should fail")
+	}
+}
+
+func TestInterceptorDB(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	var ops []Operation
+	id, err := UseStorageInterceptor(sqliteStorageName, func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error {
+		err := next(ctx)
+		ops = append(ops, *op)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveHook(id)
+
+	db := o.DB()
+	var list []*TestAuthorM
+	if err = db.QueryContextP(ctx, &list, "SELECT * FROM author WHERE name = ?", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	stmt, err := db.PrepareContextP(ctx, "SELECT * FROM author")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = stmt.Close() }()
+	if err = stmt.QueryContextP(ctx, &list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 3 || len(ops) != 2 {
+		t.Fatalf("db query fail, list = %+v, ops = %+v", list, ops)
+	}
+	for _, op := range ops {
+		if op.Action != Select || op.Storage != sqliteStorageName || op.End.IsZero() {
+			t.Errorf("db operation fail, op = %+v", op)
+		}
+	}
+	if ops[1].Query != "SELECT * FROM author" {
+		t.Errorf("stmt operation query fail, op = %+v", ops[1])
+	}
+}
+
+func TestInterceptorSavepoint(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	var queries []string
+	no := o.WithInterceptor(func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error {
+		if op.Action == Exec {
+			queries = append(queries, op.Query)
+		}
+		return next(ctx)
+	})
+
+	errFail := errors.New("fail")
+	err := no.Transaction(ctx, func(ctx context.Context, to *orm) error {
+		err := to.Transaction(ctx, func(ctx context.Context, to *orm) error {
+			return errFail
+		})
+		if err != errFail {
+			return errors.New("inner transaction should fail")
+		}
+		return to.Transaction(ctx, func(ctx context.Context, to *orm) error {
+			_, err := to.Insert(ctx, &TestAuthorM{Name: "c"})
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"SAVEPOINT porm_sp_1", "ROLLBACK TO SAVEPOINT porm_sp_1", "SAVEPOINT porm_sp_2", "RELEASE SAVEPOINT porm_sp_2"}
+	if !reflect.DeepEqual(queries, expect) {
+		t.Errorf("savepoint operation fail, queries = %v", queries)
+	}
+
+	// BeforeExec 调用 Abort 时不创建 savepoint
+	stop := errors.New("stop")
+	err = o.Transaction(ctx, func(ctx context.Context, to *orm) error {
+		return to.WithHook(func(ctx context.Context, o *orm) {
+			if op := OperationFromContext(ctx); op.Action == Exec {
+				o.Abort(stop)
+			}
+		}, BeforeExec).Transaction(ctx, func(ctx context.Context, to *orm) error {
+			t.Error("savepoint should not be created")
+			return nil
+		})
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("abort savepoint fail, err = %v", err)
+	}
+}
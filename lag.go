@@ -0,0 +1,117 @@
+package porm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/yongpi/putil/plog"
+)
+
+// LagProbe 测量从库的复制延迟
+type LagProbe interface {
+	Lag(ctx context.Context, db *DB) (time.Duration, error)
+}
+
+// MySQLLagProbe 使用 SHOW REPLICA STATUS 的 Seconds_Behind_Source，低版本使用 SHOW SLAVE STATUS 的 Seconds_Behind_Master
+type MySQLLagProbe struct{}
+
+func (MySQLLagProbe) Lag(ctx context.Context, db *DB) (time.Duration, error) {
+	rows, err := db.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		// 8.0.22 之前的版本
+		rows, err = db.QueryContext(ctx, "SHOW SLAVE STATUS")
+		if err != nil {
+			return 0, err
+		}
+	}
+	defer func() { _ = rows.Close() }()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	// 不是从库时没有数据
+	if !rows.Next() {
+		return 0, rows.Err()
+	}
+
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for index := range values {
+		dest[index] = &values[index]
+	}
+	if err = rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+
+	for index, column := range columns {
+		if column != "Seconds_Behind_Source" && column != "Seconds_Behind_Master" {
+			continue
+		}
+		// 复制没有运行时为 NULL
+		if values[index] == nil {
+			return 0, fmt.Errorf("[porm:MySQLLagProbe]: replication is not running")
+		}
+		seconds, err := strconv.ParseInt(string(values[index]), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, fmt.Errorf("[porm:MySQLLagProbe]: seconds behind column not found")
+}
+
+// PostgresLagProbe 使用 pg_last_xact_replay_timestamp，已经回放完收到的 wal 时延迟为 0，避免主库没有写入时误判
+type PostgresLagProbe struct{}
+
+func (PostgresLagProbe) Lag(ctx context.Context, db *DB) (time.Duration, error) {
+	const query = `SELECT CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`
+
+	var seconds float64
+	if err := db.QueryRowContext(ctx, query).Scan(&seconds); err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// lookupLagProbe 根据方言选择 LagProbe，不支持时返回 nil
+func lookupLagProbe(dialect Dialect) LagProbe {
+	if dialect == nil {
+		return nil
+	}
+
+	switch dialect.Name() {
+	case "mysql":
+		return MySQLLagProbe{}
+	case "postgres":
+		return PostgresLagProbe{}
+	}
+	return nil
+}
+
+// reportLag 记录一次延迟检查结果，检查失败时也认为延迟过大
+func (r *replica) reportLag(lag time.Duration, err error, maxLag time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status.Lag = lag
+	r.status.LagError = err
+	lagging := err != nil || lag > maxLag
+	if lagging == r.status.Lagging {
+		return
+	}
+
+	r.status.Lagging = lagging
+	if lagging {
+		atomic.StoreInt32(&r.lagging, 1)
+		plog.Errorf("[porm:replica]: exclude lagging replica, db = %s, index = %d, lag = %s, err = %v", r.Name, r.status.Index, lag, err)
+		return
+	}
+	atomic.StoreInt32(&r.lagging, 0)
+	plog.Infof("[porm:replica]: replica caught up, db = %s, index = %d, lag = %s", r.Name, r.status.Index, lag)
+}
@@ -37,16 +37,21 @@ type FieldInfo struct {
 	Index    []int
 	PK       bool
 	ReadOnly bool
+	Default  bool
 }
 
 type StructMapper struct {
 	Columns   []*FieldInfo
 	ColumnMap map[string]*FieldInfo
+	PKs       []*FieldInfo
 }
 
 func (m *StructMapper) AddColumn(column *FieldInfo) {
 	m.Columns = append(m.Columns, column)
 	m.ColumnMap[column.Name] = column
+	if column.PK {
+		m.PKs = append(m.PKs, column)
+	}
 }
 
 func (m *mapper) Load(value interface{}) (StructMapper, error) {
@@ -127,6 +132,7 @@ func (m *mapper) parseField(field reflect.StructField, mapper *StructMapper, ind
 	}
 	column.ReadOnly = tagInfo.Readonly
 	column.PK = tagInfo.PK
+	column.Default = tagInfo.Default
 
 	mapper.AddColumn(&column)
 	return mapper
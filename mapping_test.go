@@ -37,7 +37,7 @@ func TestMapping(t *testing.T) {
 		t.Error(err)
 	}
 
-	exJs := `[{"Name":"description","Index":[0],"PK":false,"ReadOnly":false},{"Name":"id","Index":[1],"PK":true,"ReadOnly":false},{"Name":"zone","Index":[2],"PK":false,"ReadOnly":false},{"Name":"title","Index":[3,0],"PK":false,"ReadOnly":false},{"Name":"sex","Index":[3,1],"PK":false,"ReadOnly":false},{"Name":"name","Index":[3,2,0],"PK":false,"ReadOnly":false},{"Name":"age","Index":[3,2,1],"PK":false,"ReadOnly":false},{"Name":"basicla","Index":[4],"PK":false,"ReadOnly":true},{"Name":"updated_at","Index":[5],"PK":false,"ReadOnly":true}]`
+	exJs := `[{"Name":"description","Index":[0],"PK":false,"ReadOnly":false,"Default":false},{"Name":"id","Index":[1],"PK":true,"ReadOnly":false,"Default":false},{"Name":"zone","Index":[2],"PK":false,"ReadOnly":false,"Default":false},{"Name":"title","Index":[3,0],"PK":false,"ReadOnly":false,"Default":false},{"Name":"sex","Index":[3,1],"PK":false,"ReadOnly":false,"Default":false},{"Name":"name","Index":[3,2,0],"PK":false,"ReadOnly":false,"Default":false},{"Name":"age","Index":[3,2,1],"PK":false,"ReadOnly":false,"Default":false},{"Name":"basicla","Index":[4],"PK":false,"ReadOnly":true,"Default":false},{"Name":"updated_at","Index":[5],"PK":false,"ReadOnly":true,"Default":false}]`
 	if string(js) != exJs {
 		t.Errorf("mapping fail, mapping = %s", string(js))
 	}
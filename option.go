@@ -0,0 +1,81 @@
+package porm
+
+import "fmt"
+
+type UpdateOption func(*updateOptions)
+
+type updateOptions struct {
+	columns map[string]bool
+	omits   map[string]bool
+	changed map[string]bool
+	nonZero bool
+}
+
+// Columns 只更新指定的列
+func Columns(columns ...string) UpdateOption {
+	return func(opts *updateOptions) {
+		if opts.columns == nil {
+			opts.columns = make(map[string]bool)
+		}
+		for _, column := range columns {
+			opts.columns[column] = true
+		}
+	}
+}
+
+// Omit 不更新指定的列
+func Omit(columns ...string) UpdateOption {
+	return func(opts *updateOptions) {
+		if opts.omits == nil {
+			opts.omits = make(map[string]bool)
+		}
+		for _, column := range columns {
+			opts.omits[column] = true
+		}
+	}
+}
+
+// NonZero 只更新非零值的列
+func NonZero() UpdateOption {
+	return func(opts *updateOptions) {
+		opts.nonZero = true
+	}
+}
+
+// onlyChanged 只更新有变化的列，由 tracker 计算得出
+func onlyChanged(columns map[string]bool) UpdateOption {
+	return func(opts *updateOptions) {
+		opts.changed = columns
+	}
+}
+
+func newUpdateOptions(sm StructMapper, options []UpdateOption) (*updateOptions, error) {
+	opts := &updateOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+
+	for _, list := range []map[string]bool{opts.columns, opts.omits} {
+		for column := range list {
+			field, ok := sm.ColumnMap[column]
+			if !ok {
+				return nil, fmt.Errorf("[porm:newUpdateOptions]: column not found, column = %s", column)
+			}
+			if field.PK || field.ReadOnly {
+				return nil, fmt.Errorf("[porm:newUpdateOptions]: column can not be updated, column = %s", column)
+			}
+		}
+	}
+
+	return opts, nil
+}
+
+func (opts *updateOptions) skip(column *FieldInfo) bool {
+	if opts.columns != nil && !opts.columns[column.Name] {
+		return true
+	}
+	if opts.changed != nil && !opts.changed[column.Name] {
+		return true
+	}
+	return opts.omits[column.Name]
+}
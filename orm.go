@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/yongpi/putil/plog"
 
@@ -18,6 +19,8 @@ const (
 	Insert
 	Update
 	Delete
+	// Exec 事务中的 SAVEPOINT 等语句
+	Exec
 )
 
 type Model interface {
@@ -30,17 +33,25 @@ func ORM() *orm {
 }
 
 func NORM(storageName string) *orm {
-	orm := &orm{storage: depository[storageName]}
+	orm := &orm{storage: lookupStorage(storageName)}
 	return orm
 }
 
 type orm struct {
-	storage      Storage
-	sqlAction    SqlAction
-	forceMaster  bool
-	tx           *Tx
+	storage     Storage
+	sqlAction   SqlAction
+	forceMaster bool
+	flatten     bool
+	// stmtTx TxHook 为当前语句开启或者加入了事务，需要在 After hook 中结束
+	stmtTx       bool
+	hooks        map[HookType][]hookEntry
+	interceptors []interceptorEntry
+	table        string
+	// db 本次操作使用的 db，由 trackedStorage 在执行前确定
+	db           *DB
+	shard        *shardRoute
+	tx           *transaction
 	err          error
-	txCount      int64
 	sqlStatement psql.SqlStatement
 }
 
@@ -48,105 +59,293 @@ func (o *orm) Copy(dest *orm) {
 	o.storage = dest.storage
 	o.tx = dest.tx
 	o.forceMaster = dest.forceMaster
-	o.txCount = dest.txCount
 	o.err = dest.err
 }
 
-func (o *orm) BeginTx(ctx context.Context) (*orm, error) {
-	to := TxORMFromContext(ctx)
-	if to != nil && to.StorageName() == o.StorageName() {
+func (o *orm) BeginTx(ctx context.Context, options ...TxOptions) (*orm, error) {
+	opts := txOptions(options)
+	to, err := o.txORM(ctx)
+	// 挂起外层事务的传播方式不需要加入外层事务
+	if err != nil && opts.Propagation != PropagationRequiresNew && opts.Propagation != PropagationNotSupported {
+		return nil, err
+	}
 
-		plog.Infof("[porm:orm:BeginTx]: begin tx from context, db = %s", to.StorageName())
+	switch opts.Propagation {
+	case PropagationRequired:
+		if to != nil {
+			return o.joinTx(ctx, to, !o.flatten)
+		}
+	case PropagationNested:
+		if to != nil {
+			return o.joinTx(ctx, to, true)
+		}
+	case PropagationSupports:
+		if to != nil {
+			return o.joinTx(ctx, to, !o.flatten)
+		}
+		return o.suspendTx(), nil
+	case PropagationMandatory:
+		if to == nil {
+			return nil, fmt.Errorf("[porm:orm:BeginTx]: propagation %s need an existing tx, db = %s", opts.Propagation, o.StorageName())
+		}
+		return o.joinTx(ctx, to, !o.flatten)
+	case PropagationNever:
+		if to != nil {
+			return nil, fmt.Errorf("[porm:orm:BeginTx]: propagation %s can not run in an existing tx, db = %s", opts.Propagation, o.StorageName())
+		}
+		return o.suspendTx(), nil
+	case PropagationNotSupported:
+		return o.suspendTx(), nil
+	case PropagationRequiresNew:
+	default:
+		return nil, fmt.Errorf("[porm:orm:BeginTx]: unknown propagation %s", opts.Propagation)
+	}
+
+	return o.newTx(ctx, opts)
+}
+
+// statementTx 单条语句使用的事务，已经在事务或者不使用事务的作用域中时直接加入，不需要 savepoint
+func (o *orm) statementTx(ctx context.Context) (*orm, error) {
+	if o.tx.active() {
+		if !o.sameShardDB(o.tx) {
+			return nil, o.shardTxError()
+		}
+		return o.joinTx(ctx, o, false)
+	}
 
-		to.txCount++
-		return to, nil
+	to, err := o.txORM(ctx)
+	if err != nil {
+		return nil, err
 	}
+	if to != nil {
+		return o.joinTx(ctx, to, false)
+	}
+	return o.newTx(ctx, TxOptions{})
+}
 
-	o.ForceMaster()
-	tx, err := o.DB().BeginTxP(ctx, nil)
+// joinTx 加入 to 的事务，返回的 orm 保留 o 的 hook 等设置
+func (o *orm) joinTx(ctx context.Context, to *orm, savepoint bool) (*orm, error) {
+	name, err := to.tx.join(ctx, savepoint, o.execTx)
 	if err != nil {
 		return nil, err
 	}
-	o.tx = tx
 
-	plog.Infof("[porm:orm:BeginTx]: begin tx, db = %s", o.StorageName())
+	plog.Infof("[porm:orm:BeginTx]: begin tx from context, db = %s, savepoint = %s", o.StorageName(), name)
 
-	o.txCount++
-	return o, nil
+	no := o.detach()
+	no.forceMaster = true
+	no.tx = to.tx
+	return no, nil
+}
+
+// execTx 执行事务控制语句，和其他语句一样经过拦截器和 BeforeExec、AfterExec hook
+func (o *orm) execTx(ctx context.Context, tx *Tx, query string) error {
+	so := o.session()
+	so.sqlAction = Exec
+	so.table = ""
+	return so.interceptChain(ctx, &Operation{Query: query}, func(ctx context.Context, op *Operation) error {
+		_, err := tx.ExecContext(ctx, op.Query, op.Args...)
+		return err
+	})
+}
+
+// newTx 在新的 orm 上开启事务，不修改 o
+func (o *orm) newTx(ctx context.Context, opts TxOptions) (*orm, error) {
+	no := o.detach()
+	no.forceMaster = true
+
+	Fishing(ctx, BeforeBegin, no)
+	if no.err != nil {
+		return nil, no.err
+	}
+
+	db, err := no.resolveDB()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTxP(ctx, opts.sqlTxOptions())
+	if err != nil {
+		return nil, err
+	}
+	no.tx = newTransaction(ctx, tx, db)
+
+	plog.Infof("[porm:orm:BeginTx]: begin tx, db = %s, propagation = %s", no.StorageName(), opts.Propagation)
+
+	return no, nil
+}
+
+// suspendTx 开启一个不使用事务的作用域，作用域内的语句不会加入外层事务
+func (o *orm) suspendTx() *orm {
+	no := o.detach()
+	no.tx = newTransaction(nil, nil, nil)
+	return no
+}
+
+// detach 返回不带事务和语句的副本
+func (o *orm) detach() *orm {
+	return &orm{storage: o.storage, forceMaster: o.forceMaster, flatten: o.flatten, hooks: o.hooks, interceptors: o.interceptors, shard: o.shard}
+}
+
+// session 每次操作使用的副本，操作中修改的 sqlAction、err 等状态不会影响 o，o 可以在多个 goroutine 中使用
+func (o *orm) session() *orm {
+	no := *o
+	no.err = nil
+	return &no
+}
+
+// txORM 返回正在进行中的事务所在的 orm，自身的事务优先于 context 中的事务；
+// 分片不在事务所在的库中时返回错误，不能在事务外执行
+func (o *orm) txORM(ctx context.Context) (*orm, error) {
+	to := o
+	if o.tx.live() == nil {
+		to = StorageTxORMFromContext(ctx, o.StorageName())
+		if to == nil || to.tx.live() == nil {
+			return nil, nil
+		}
+	}
+
+	if !o.sameShardDB(to.tx) {
+		return nil, o.shardTxError()
+	}
+	return to, nil
 }
 
 func (o *orm) Commit() error {
-	o.txCount--
 	if o.tx == nil {
 		return fmt.Errorf("[porm:orm:Commit]:orm tx can not be nil")
 	}
 
 	plog.Infof("[porm:orm:Commit]: commit tx, db = %s", o.StorageName())
 
-	if o.txCount == 0 {
-		return o.tx.Commit()
+	outermost := o.tx.outermost()
+	err := o.tx.commit(o.execTx)
+	if outermost {
+		o.fishTxEnd(err == nil)
 	}
-
-	return nil
+	return err
 }
 
 func (o *orm) Rollback() error {
-	o.txCount--
 	if o.tx == nil {
 		return fmt.Errorf("[porm:orm:Rollback]:orm tx can not be nil")
 	}
 
 	plog.Infof("[porm:orm:Rollback]: rollback tx, db = %s", o.StorageName())
 
-	if o.txCount == 0 {
-		return o.tx.Rollback()
+	outermost := o.tx.outermost()
+	err := o.tx.rollback(o.execTx)
+	if outermost {
+		o.fishTxEnd(false)
 	}
-	return nil
+	return err
 }
 
 func (o *orm) MustRollback() {
-	o.txCount--
 	if o.tx == nil {
 		panic("[porm:orm:MustRollback]:orm tx can not be nil")
 	}
 
 	plog.Infof("[porm:orm:MustRollback]: rollback tx, db = %s", o.StorageName())
 
-	if o.txCount == 0 {
-		err := o.tx.Rollback()
-		if err != nil {
-			panic(fmt.Errorf("[porm:orm:MustRollback]: rollback error, err = %s", err.Error()))
-		}
+	outermost := o.tx.outermost()
+	err := o.tx.rollback(o.execTx)
+	if outermost {
+		o.fishTxEnd(false)
+	}
+	if err != nil {
+		panic(fmt.Errorf("[porm:orm:MustRollback]: rollback error, err = %s", err.Error()))
 	}
 }
 
-func (o *orm) Transaction(ctx context.Context, fun func(ctx context.Context, orm *orm) error) error {
-	no, err := o.BeginTx(ctx)
+// fishTxEnd 最外层事务结束后执行 AfterCommit 或者 AfterRollback
+func (o *orm) fishTxEnd(committed bool) {
+	hookType := AfterRollback
+	if committed {
+		hookType = AfterCommit
+	}
+	Fishing(o.tx.ctx, hookType, o.session())
+}
+
+// OnCommit 注册事务提交后执行的回调，最外层事务提交成功后才执行；不在事务中时直接执行
+func (o *orm) OnCommit(ctx context.Context, fun func(ctx context.Context)) error {
+	to, err := o.txORM(ctx)
 	if err != nil {
 		return err
 	}
+	if to == nil {
+		runTxCallbacks([]txCallback{{ctx: ctx, fun: fun}})
+		return nil
+	}
+	return to.tx.register(ctx, fun, true)
+}
+
+// OnRollback 注册事务回滚后执行的回调，最外层事务回滚或者提交失败、所在的 savepoint 回滚时，在最外层事务结束后执行；不在事务中时不会执行
+func (o *orm) OnRollback(ctx context.Context, fun func(ctx context.Context)) error {
+	to, err := o.txORM(ctx)
+	if to == nil {
+		return err
+	}
+	return to.tx.register(ctx, fun, false)
+}
+
+func (o *orm) Transaction(ctx context.Context, fun func(ctx context.Context, orm *orm) error, options ...TxOptions) error {
+	opts := txOptions(options)
+	for attempt := 1; ; attempt++ {
+		no, err := o.BeginTx(ctx, opts)
+		if err != nil {
+			return err
+		}
+
+		// 只有最外层的事务可以重试，加入外层的事务出错时由外层决定
+		retry := opts.Retry != nil && no.tx.outermost()
 
-	ctx = WithTxContext(ctx, no)
+		err = no.runTx(ctx, fun)
+		if err == nil || !retry || !opts.Retry.retryable(no.Dialect(), err) || attempt >= opts.Retry.MaxAttempts {
+			return err
+		}
+
+		info := &TxRetry{Attempt: attempt, Err: err, Delay: opts.Retry.delay(attempt)}
+		plog.Infof("[porm:orm:Transaction]: retry tx, db = %s, attempt = %d, delay = %s, err = %s", o.StorageName(), attempt, info.Delay, err)
+
+		so := no.session()
+		Fishing(withTxRetry(ctx, info), BeforeTxRetry, so)
+		if so.err != nil {
+			return so.err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(info.Delay):
+		}
+	}
+}
+
+func (o *orm) runTx(ctx context.Context, fun func(ctx context.Context, orm *orm) error) error {
+	ctx = WithTxContext(ctx, o)
 	defer func() {
 		if err := recover(); err != nil {
-			no.MustRollback()
+			o.MustRollback()
 			panic(err)
 		}
 	}()
 
-	err = fun(ctx, no)
+	err := fun(ctx, o)
 	if err != nil {
-		err2 := no.Rollback()
+		err2 := o.Rollback()
 		if err2 != nil {
 			return fmt.Errorf("[porm:orm:Transaction]: rollback fail, err = %s", err2)
 		}
 		return err
 	}
 
-	return no.Commit()
+	return o.Commit()
 }
 
 func (o *orm) DB() *DB {
+	if o.db != nil {
+		return o.db
+	}
 	return o.storage.GetDB(o)
 }
 
@@ -162,37 +361,67 @@ func (o *orm) SqlBuilder() psql.SqlBuilder {
 	return o.storage.SqlBuilder()
 }
 
+func (o *orm) Dialect() Dialect {
+	return o.storage.Dialect()
+}
+
 func (o *orm) ForceMaster() *orm {
-	o.forceMaster = true
-	return o
+	no := o.session()
+	no.forceMaster = true
+	return no
+}
+
+// Flatten 嵌套的事务不再使用 savepoint，直接加入外层事务，内层回滚时不做处理
+func (o *orm) Flatten() *orm {
+	no := o.session()
+	no.flatten = true
+	return no
+}
+
+// WithHook 返回带有 hook 的 orm，hook 只对返回的 orm 生效
+func (o *orm) WithHook(hook Hook, hookType HookType) *orm {
+	no := o.session()
+	no.hooks = make(map[HookType][]hookEntry, len(o.hooks)+1)
+	for t, entries := range o.hooks {
+		no.hooks[t] = entries
+	}
+	no.hooks[hookType] = append(append([]hookEntry(nil), o.hooks[hookType]...), hookEntry{hook: hook})
+	return no
 }
 
 func (o *orm) WithStatement(statement psql.SqlStatement) *orm {
-	o.sqlStatement = statement
-	return o
+	no := o.session()
+	no.sqlStatement = statement
+	return no
 }
 
-func (o *orm) SelectPK(ctx context.Context, id int64, model interface{}) error {
-	pk, err := PickUpPK(o.Mapper(), model)
+func (o *orm) SelectPK(ctx context.Context, pk interface{}, model interface{}) error {
+	cond, err := o.pkCond(model, pk)
 	if err != nil {
 		return err
 	}
 
-	statement := psql.Select("*").Where(psql.Eq{pk: id})
+	statement := psql.Select("*").Where(cond)
 	return o.WithStatement(statement).Select(ctx, model)
 }
 
-func (o *orm) SelectPKS(ctx context.Context, ids []int64, model interface{}) error {
-	pk, err := PickUpPK(o.Mapper(), model)
+func (o *orm) SelectPKS(ctx context.Context, pks interface{}, model interface{}) error {
+	keys, err := splitKeys(pks)
 	if err != nil {
 		return err
 	}
 
-	statement := psql.Select("*").Where(psql.Eq{pk: ids})
+	cond, err := o.pkCond(model, keys...)
+	if err != nil {
+		return err
+	}
+
+	statement := psql.Select("*").Where(cond)
 	return o.WithStatement(statement).Select(ctx, model)
 }
 
 func (o *orm) Select(ctx context.Context, model interface{}) error {
+	o = o.session()
 	o.sqlAction = Select
 	if o.sqlStatement == nil {
 		return fmt.Errorf("[porm:orm:Select] st can not be nil")
@@ -202,12 +431,27 @@ func (o *orm) Select(ctx context.Context, model interface{}) error {
 		return fmt.Errorf("[porm:orm:Select] statement must be *psql.SelectStatement")
 	}
 
+	// 分片的 storage 没有指定分片时查询所有分片，合并后重新排序和分页
+	if n := o.shardCount(); n > 0 {
+		return o.selectShards(ctx, st, model, n)
+	}
+
+	// 从 model 中获取的列名和表名需要加引号
+	fillColumns := len(st.Columns) == 0 || st.Columns[0] == "*"
+	fillTable := st.TableName == ""
 	err := FillSelect(o.Mapper(), st, model, o.SqlBuilder().HolderType)
 	if err != nil {
 		return err
 	}
+	if fillColumns {
+		st.Columns = quoteColumns(o.Dialect(), st.Columns)
+	}
+	o.table = st.TableName
+	if fillTable {
+		st.TableName = quoteIdent(o.Dialect(), st.TableName)
+	}
 
-	query, args, err := st.ToSql()
+	query, args, err := o.selectSql(st)
 	if err != nil {
 		return err
 	}
@@ -222,23 +466,38 @@ func (o *orm) Select(ctx context.Context, model interface{}) error {
 
 	defer Fishing(ctx, AfterSelect, o)
 
-	var stmt *Stmt
-	if o.tx != nil {
-		stmt, err = o.tx.PrepareContextP(ctx, query)
-	} else {
-		stmt, err = o.DB().PrepareContextP(ctx, query)
-	}
-	if err != nil {
-		o.err = err
-		return o.err
+	// 先执行 AfterFind 再记录，记录的是 AfterFind 处理后的值
+	visit := afterFindVisitor(ctx)
+	tk := trackerFrom(ctx)
+	if tk != nil {
+		track := tk.visitor(o.Mapper())
+		visit = func(ptr reflect.Value) error {
+			if err := callAfterFind(ctx, ptr.Interface()); err != nil {
+				return err
+			}
+			return track(ptr)
+		}
 	}
-	defer func() {
-		if err := stmt.Close(); err != nil {
-			plog.WithError(err).Error("[porm:orm:Select]: stmt close fail")
+	moved := tk.watch(model)
+	defer moved()
+
+	err = o.intercept(ctx, &Operation{Query: query, Args: args}, func(ctx context.Context, op *Operation) error {
+		stmt, err := o.prepare(ctx, op.Query)
+		if err != nil {
+			return err
 		}
-	}()
+		defer func() {
+			if err := stmt.Close(); err != nil {
+				plog.WithError(err).Error("[porm:orm:Select]: stmt close fail")
+			}
+		}()
 
-	err = stmt.QueryContextP(ctx, model, args...)
+		rows, err := stmt.QueryContext(ctx, op.Args...)
+		if err != nil {
+			return err
+		}
+		return scan(o.Mapper(), model, rows, visit)
+	})
 	if err != nil {
 		o.err = err
 		return o.err
@@ -248,6 +507,29 @@ func (o *orm) Select(ctx context.Context, model interface{}) error {
 }
 
 func (o *orm) SelectWithCount(ctx context.Context, model interface{}, count *int64) error {
+	// 分片的 storage 没有指定分片时查询所有分片，列表为合并后的结果，数量为所有分片的和
+	if n := o.shardCount(); n > 0 {
+		st, ok := o.sqlStatement.(*psql.SelectStatement)
+		if !ok {
+			return fmt.Errorf("[porm:orm:SelectWithCount] statement must be *psql.SelectStatement")
+		}
+
+		err := o.Select(ctx, model)
+		if err != nil {
+			return err
+		}
+
+		*count = 0
+		for index := 0; index < n; index++ {
+			shardCount, err := o.onShard(index).selectCount(ctx, model, st)
+			if err != nil {
+				return err
+			}
+			*count += shardCount
+		}
+		return nil
+	}
+
 	err := o.Select(ctx, model)
 	if err != nil {
 		return err
@@ -258,31 +540,49 @@ func (o *orm) SelectWithCount(ctx context.Context, model interface{}, count *int
 		return fmt.Errorf("[porm:orm:SelectWithCount] statement must be *psql.SelectStatement")
 	}
 
-	st.Columns = []string{"COUNT(1)"}
-	st.LimitValue = nil
-	st.OffsetValue = nil
+	*count, err = o.selectCount(ctx, model, st)
+	return err
+}
 
-	query, args, err := st.ToSql()
+// selectCount 按 st 的条件查询数量，不修改 st，表名为空时从 model 中获取
+func (o *orm) selectCount(ctx context.Context, model interface{}, st *psql.SelectStatement) (int64, error) {
+	cst := *st
+	cst.Columns = []string{"COUNT(1)"}
+	cst.LimitValue = nil
+	cst.OffsetValue = nil
+	cst.HolderType = o.SqlBuilder().HolderType
+	if cst.TableName == "" {
+		table, err := PickUpTable(model)
+		if err != nil {
+			return 0, err
+		}
+		cst.TableName = quoteIdent(o.Dialect(), table)
+	}
+
+	query, args, err := o.selectSql(&cst)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	rows, err := o.SelectX(ctx, query, args...)
+	rows, err := o.withModelTable(model).SelectX(ctx, query, args...)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer func() { _ = rows.Close() }()
 
+	var count int64
 	if rows.Next() {
-		err = rows.Scan(count)
+		err = rows.Scan(&count)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
 
-	return nil
+	return count, nil
 }
 
 func (o *orm) SelectX(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	o = o.session()
 	o.sqlAction = Select
 
 	// 执行 hook
@@ -296,84 +596,179 @@ func (o *orm) SelectX(ctx context.Context, query string, args ...interface{}) (*
 	// 打印日志
 	plog.Debugf("[porm:orm:SelectX]: query sql = %s, args = %#v", query, args)
 
-	var (
-		stmt *Stmt
-		err  error
-	)
-
-	if o.tx != nil {
-		stmt, err = o.tx.PrepareContextP(ctx, query)
-	} else {
-		stmt, err = o.DB().PrepareContextP(ctx, query)
-	}
+	var rows *sql.Rows
+	err := o.intercept(ctx, &Operation{Query: query, Args: args}, func(ctx context.Context, op *Operation) error {
+		stmt, err := o.prepare(ctx, op.Query)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := stmt.Close()
+			if err != nil {
+				plog.WithError(err).Error("[porm:orm:SelectX]: stmt close fail")
+			}
+		}()
+
+		rows, err = stmt.QueryContext(ctx, op.Args...)
+		return err
+	})
 	if err != nil {
 		o.err = err
 		return nil, o.err
 	}
+
+	return rows, o.err
+}
+
+// selectSql LIMIT 和 OFFSET 由 dialect 生成
+func (o *orm) selectSql(st *psql.SelectStatement) (string, []interface{}, error) {
+	limit, offset := st.LimitValue, st.OffsetValue
+	st.LimitValue, st.OffsetValue = nil, nil
 	defer func() {
-		err := stmt.Close()
-		if err != nil {
-			plog.WithError(err).Error("[porm:orm:SelectX]: stmt close fail")
-		}
+		st.LimitValue, st.OffsetValue = limit, offset
 	}()
 
-	rows, err := stmt.QueryContext(ctx, args...)
+	query, args, err := st.ToSql()
 	if err != nil {
-		o.err = err
-		return nil, o.err
+		return "", nil, err
 	}
-
-	return rows, o.err
+	return query + o.Dialect().LimitOffset(limit, offset), args, nil
 }
 
-func (o *orm) exec(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
-	var stmt *Stmt
-	if o.tx != nil {
-		stmt, err = o.tx.PrepareContextP(ctx, query)
-	} else {
-		stmt, err = o.DB().PrepareContextP(ctx, query)
+func (o *orm) prepare(ctx context.Context, query string) (*Stmt, error) {
+	query = o.Dialect().Rebind(query)
+	if tx := o.tx.live(); tx != nil {
+		// 不在事务所在库中的分片只能读，读的时候不使用事务
+		if o.sameShardDB(o.tx) {
+			return tx.PrepareContextP(ctx, query)
+		}
+		if o.sqlAction != Select {
+			return nil, o.shardTxError()
+		}
 	}
+
+	db, err := o.resolveDB()
 	if err != nil {
-		o.err = err
-		return nil, o.err
+		return nil, err
 	}
+	return db.PrepareContextP(ctx, query)
+}
+
+func (o *orm) exec(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	err = o.intercept(ctx, &Operation{Query: query, Args: args}, func(ctx context.Context, op *Operation) error {
+		stmt, err := o.prepare(ctx, op.Query)
+		if err != nil {
+			return err
+		}
 
-	defer func() { _ = stmt.Close() }()
+		defer func() { _ = stmt.Close() }()
 
-	result, err = stmt.ExecContext(ctx, args...)
+		result, err = stmt.ExecContext(ctx, op.Args...)
+		if err != nil {
+			return err
+		}
+
+		// 有的驱动不支持 RowsAffected，忽略错误
+		op.RowsAffected, _ = result.RowsAffected()
+		return nil
+	})
 	if err != nil {
 		o.err = err
 		return nil, o.err
 	}
 
 	return result, nil
+}
+
+// insertReturning 执行带 RETURNING 的 insert 语句，返回生成的主键
+func (o *orm) insertReturning(ctx context.Context, query string, args ...interface{}) ([]int64, error) {
+	o = o.session()
+	o.sqlAction = Insert
+
+	// 打印日志
+	plog.Debugf("[porm:orm:insertReturning]: query sql = %s, args = %#v", query, args)
+
+	// 执行 hook
+	Fishing(ctx, BeforeInsert, o)
+	if o.err != nil {
+		return nil, o.abortStatement()
+	}
+
+	var ids []int64
+	err := o.intercept(ctx, &Operation{Query: query, Args: args}, func(ctx context.Context, op *Operation) error {
+		stmt, err := o.prepare(ctx, op.Query)
+		if err != nil {
+			return err
+		}
+
+		defer func() { _ = stmt.Close() }()
+
+		rows, err := stmt.QueryContext(ctx, op.Args...)
+		if err != nil {
+			return err
+		}
+
+		defer func() { _ = rows.Close() }()
 
+		for rows.Next() {
+			var id int64
+			err = rows.Scan(&id)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		op.RowsAffected = int64(len(ids))
+		return nil
+	})
+	if err != nil {
+		o.err = err
+	}
+	if err = o.fishAfter(ctx, AfterInsert); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
 }
 
 func (o *orm) Update(ctx context.Context, model interface{}) (sql.Result, error) {
 	if o.sqlStatement == nil {
 		return nil, fmt.Errorf("[porm:orm:Update] st can not be nil")
 	}
+	o, err := o.shardBy(model)
+	if err != nil {
+		return nil, err
+	}
 
 	st, ok := o.sqlStatement.(*psql.UpdateStatement)
 	if !ok {
 		return nil, fmt.Errorf("[porm:orm:Update] statement must be *psql.UpdateStatement")
 	}
 
-	err := FillUpdate(st, model, o.SqlBuilder().HolderType)
+	fillTable := st.TableName == ""
+	err = FillUpdate(st, model, o.SqlBuilder().HolderType)
 	if err != nil {
 		return nil, err
 	}
+	table := st.TableName
+	if fillTable {
+		st.TableName = quoteIdent(o.Dialect(), st.TableName)
+	}
 
 	query, args, err := st.ToSql()
 	if err != nil {
 		return nil, err
 	}
 
-	return o.UpdateX(ctx, query, args...)
+	return o.withTable(table).UpdateX(ctx, query, args...)
 }
 
 func (o *orm) UpdateX(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	o = o.session()
 	o.sqlAction = Update
 
 	// 打印日志
@@ -382,15 +777,28 @@ func (o *orm) UpdateX(ctx context.Context, query string, args ...interface{}) (s
 	// 执行 hook
 	Fishing(ctx, BeforeUpdate, o)
 	if o.err != nil {
-		return nil, o.err
+		return nil, o.abortStatement()
 	}
 
-	defer Fishing(ctx, AfterUpdate, o)
+	result, err := o.exec(ctx, query, args...)
+	if err = o.fishAfter(ctx, AfterUpdate); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
 
-	return o.exec(ctx, query, args...)
+func (o *orm) UpdateModel(ctx context.Context, model interface{}, options ...UpdateOption) (sql.Result, error) {
+	return o.withModelCallbacks(ctx, model, updateCallbacks, func(ctx context.Context, o *orm) (sql.Result, error) {
+		return o.updateModel(ctx, model, options...)
+	})
 }
 
-func (o *orm) UpdateModel(ctx context.Context, model interface{}) (sql.Result, error) {
+func (o *orm) updateModel(ctx context.Context, model interface{}, options ...UpdateOption) (sql.Result, error) {
+	o, err := o.shardBy(model)
+	if err != nil {
+		return nil, err
+	}
+
 	table, ok := model.(Model)
 	if !ok {
 		return nil, fmt.Errorf("[porm:orm:UpdateModel]: model must implement Model interface")
@@ -400,20 +808,30 @@ func (o *orm) UpdateModel(ctx context.Context, model interface{}) (sql.Result, e
 	if value.Kind() != reflect.Struct {
 		return nil, fmt.Errorf("[porm:orm:UpdateModel]: value must be struct")
 	}
-	sm, err := o.Mapper().Load(value.Type())
+	var tracked bool
+	tk := trackerFrom(ctx)
+	if tk != nil {
+		sm, err := o.Mapper().Load(value.Type())
+		if err != nil {
+			return nil, err
+		}
+		var changed map[string]bool
+		changed, tracked = tk.changed(sm, reflect.ValueOf(model))
+		if tracked {
+			options = append(options, onlyChanged(changed))
+		}
+	}
+
+	st := o.SqlBuilder().Update(quoteIdent(o.Dialect(), table.TableName()))
+	err = BuilderUpdateModel(o.Mapper(), o.Dialect(), st, value, options...)
 	if err != nil {
 		return nil, err
 	}
-	st := o.SqlBuilder().Update(table.TableName())
-	for _, column := range sm.Columns {
-		if column.PK {
-			st.Where(psql.Eq{column.Name: value.FieldByIndex(column.Index).Interface()})
-			continue
-		}
-		if column.ReadOnly {
-			continue
+	if len(st.Sets) == 0 {
+		if tracked {
+			return noopResult{}, nil
 		}
-		st.Set(column.Name, CoverNullValue(value.FieldByIndex(column.Index).Interface()))
+		return nil, fmt.Errorf("[porm:orm:UpdateModel]: no column to update")
 	}
 
 	query, args, err := st.ToSql()
@@ -421,33 +839,59 @@ func (o *orm) UpdateModel(ctx context.Context, model interface{}) (sql.Result, e
 		return nil, err
 	}
 
-	return o.UpdateX(ctx, query, args...)
+	result, err := o.withTable(table.TableName()).UpdateX(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if tracked {
+		// 快照在事务提交后再更新，事务回滚或者重试时还能比较出有变化的列
+		save, err := tk.capture(o.Mapper(), reflect.ValueOf(model))
+		if err != nil {
+			return nil, err
+		}
+		err = o.OnCommit(ctx, func(ctx context.Context) { save() })
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
 }
 
 func (o *orm) Delete(ctx context.Context, model interface{}) (sql.Result, error) {
 	if o.sqlStatement == nil {
 		return nil, fmt.Errorf("[porm:orm:Delete] st can not be nil")
 	}
+	o, err := o.shardBy(model)
+	if err != nil {
+		return nil, err
+	}
 
 	st, ok := o.sqlStatement.(*psql.DeleteStatement)
 	if !ok {
 		return nil, fmt.Errorf("[porm:orm:Delete] statement must be *psql.DeleteStatement")
 	}
 
-	err := FillDelete(st, model, o.SqlBuilder().HolderType)
+	fillTable := st.TableName == ""
+	err = FillDelete(st, model, o.SqlBuilder().HolderType)
 	if err != nil {
 		return nil, err
 	}
+	table := st.TableName
+	if fillTable {
+		st.TableName = quoteIdent(o.Dialect(), st.TableName)
+	}
 
 	query, args, err := st.ToSql()
 	if err != nil {
 		return nil, err
 	}
 
-	return o.DeleteX(ctx, query, args...)
+	return o.withTable(table).DeleteX(ctx, query, args...)
 }
 
 func (o *orm) DeleteX(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	o = o.session()
 	o.sqlAction = Delete
 	// 打印日志
 	plog.Debugf("[porm:orm:DeleteX]: query sql = %s, args = %#v", query, args)
@@ -455,15 +899,97 @@ func (o *orm) DeleteX(ctx context.Context, query string, args ...interface{}) (s
 	// 执行 hook
 	Fishing(ctx, BeforeDelete, o)
 	if o.err != nil {
-		return nil, o.err
+		return nil, o.abortStatement()
+	}
+
+	result, err := o.exec(ctx, query, args...)
+	if err = o.fishAfter(ctx, AfterDelete); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (o *orm) DeleteModel(ctx context.Context, model interface{}) (sql.Result, error) {
+	return o.withModelCallbacks(ctx, model, deleteCallbacks, func(ctx context.Context, o *orm) (sql.Result, error) {
+		return o.deleteModel(ctx, model)
+	})
+}
+
+func (o *orm) deleteModel(ctx context.Context, model interface{}) (sql.Result, error) {
+	o, err := o.shardBy(model)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := PickUpTable(model)
+	if err != nil {
+		return nil, err
+	}
+
+	cond, err := ModelPKCond(o.Mapper(), reflect.ValueOf(model))
+	if err != nil {
+		return nil, err
+	}
+	cond.Columns = quoteColumns(o.Dialect(), cond.Columns)
+
+	return o.deleteWhere(ctx, table, cond)
+}
+
+func (o *orm) DeleteByPK(ctx context.Context, pk interface{}, model interface{}) (sql.Result, error) {
+	table, err := PickUpTable(model)
+	if err != nil {
+		return nil, err
+	}
+
+	cond, err := o.pkCond(model, pk)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.deleteWhere(ctx, table, cond)
+}
+
+func (o *orm) DeleteByPKs(ctx context.Context, pks interface{}, model interface{}) (sql.Result, error) {
+	table, err := PickUpTable(model)
+	if err != nil {
+		return nil, err
 	}
 
-	defer Fishing(ctx, AfterDelete, o)
+	keys, err := splitKeys(pks)
+	if err != nil {
+		return nil, err
+	}
 
-	return o.exec(ctx, query, args...)
+	cond, err := o.pkCond(model, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.deleteWhere(ctx, table, cond)
+}
+
+// pkCond 构建加好引号的主键条件
+func (o *orm) pkCond(model interface{}, keys ...interface{}) (PKCond, error) {
+	cond, err := BuildPKCond(o.Mapper(), model, keys...)
+	if err != nil {
+		return PKCond{}, err
+	}
+
+	cond.Columns = quoteColumns(o.Dialect(), cond.Columns)
+	return cond, nil
+}
+
+func (o *orm) deleteWhere(ctx context.Context, table string, cond PKCond) (sql.Result, error) {
+	query, args, err := o.SqlBuilder().Delete(quoteIdent(o.Dialect(), table)).Where(cond).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	return o.withTable(table).DeleteX(ctx, query, args...)
 }
 
 func (o *orm) InsertX(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	o = o.session()
 	o.sqlAction = Insert
 
 	// 打印日志
@@ -472,26 +998,290 @@ func (o *orm) InsertX(ctx context.Context, query string, args ...interface{}) (s
 	// 执行 hook
 	Fishing(ctx, BeforeInsert, o)
 	if o.err != nil {
-		return nil, o.err
+		return nil, o.abortStatement()
 	}
 
-	defer Fishing(ctx, AfterInsert, o)
-
-	return o.exec(ctx, query, args...)
+	result, err := o.exec(ctx, query, args...)
+	if err = o.fishAfter(ctx, AfterInsert); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 func (o *orm) Insert(ctx context.Context, model interface{}) (sql.Result, error) {
-	st := psql.NewInsert(o.SqlBuilder().HolderType)
-	err := FillInsert(o.Mapper(), st, model, o.SqlBuilder().HolderType)
+	return o.withModelCallbacks(ctx, model, insertCallbacks, func(ctx context.Context, o *orm) (sql.Result, error) {
+		return o.insert(ctx, model)
+	})
+}
+
+func (o *orm) insert(ctx context.Context, model interface{}) (sql.Result, error) {
+	o, err := o.shardBy(model)
+	if err != nil {
+		return nil, err
+	}
+	o = o.withModelTable(model)
+	groups, rows, err := o.insertGroups(model)
 	if err != nil {
 		return nil, err
 	}
+	if len(groups) == 0 {
+		return noopResult{}, nil
+	}
+	if len(groups) == 1 {
+		return o.insertRows(ctx, groups[0], rows)
+	}
 
-	query, args, err := st.ToSql()
+	// 插入列不同的行分多条语句插入，放在同一个事务中
+	var result insertResult
+	err = o.Transaction(ctx, func(ctx context.Context, orm *orm) error {
+		for _, group := range groups {
+			gr, err := orm.withTable(o.table).insertRows(ctx, group, rows)
+			if err != nil {
+				return err
+			}
+
+			affected, err := gr.RowsAffected()
+			if err != nil {
+				return err
+			}
+			result.rowsAffected += affected
+
+			// mysql 没有生成主键时 LastInsertId 为 0
+			id, err := gr.LastInsertId()
+			if err == nil && id != 0 {
+				result.lastInsertID = id
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// insertRows 执行一个分组的 insert 语句，会回填自增主键
+func (o *orm) insertRows(ctx context.Context, group *InsertGroup, all []reflect.Value) (sql.Result, error) {
+	query, args, err := group.Statement.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]reflect.Value, len(group.Rows))
+	for index, row := range group.Rows {
+		rows[index] = all[row]
+	}
+
+	pk, err := pickUpGeneratedPK(o.Mapper(), rows, group.Columns)
+	if err != nil {
+		return nil, err
+	}
+	if pk == nil {
+		return o.InsertX(ctx, query, args...)
+	}
+
+	// postgres 和 sqlite 通过 RETURNING 获取自增主键
+	if o.Dialect().SupportsReturning() {
+		query = fmt.Sprintf("%s RETURNING %s", query, o.Dialect().Quote(pk.Name))
+		ids, err := o.insertReturning(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		err = fillGeneratedPK(pk, rows, ids)
+		if err != nil {
+			return nil, err
+		}
+		return newInsertResult(ids), nil
+	}
+
+	result, err := o.InsertX(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// mysql 批量插入时自增主键是连续的，LastInsertId 为第一行的主键
+	first, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(rows))
+	for index := range ids {
+		ids[index] = first + int64(index)
+	}
+
+	err = fillGeneratedPK(pk, rows, ids)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Upsert 插入数据，冲突时更新 updateColumns，updateColumns 为空时更新除冲突列和主键外的所有插入列。
+// conflictColumns 只在 postgres 和 sqlite 中使用，为空时使用主键
+func (o *orm) Upsert(ctx context.Context, model interface{}, conflictColumns []string, updateColumns []string) (sql.Result, error) {
+	return o.withModelCallbacks(ctx, model, insertCallbacks, func(ctx context.Context, o *orm) (sql.Result, error) {
+		return o.upsert(ctx, model, conflictColumns, updateColumns)
+	})
+}
+
+func (o *orm) upsert(ctx context.Context, model interface{}, conflictColumns []string, updateColumns []string) (sql.Result, error) {
+	o, err := o.shardBy(model)
+	if err != nil {
+		return nil, err
+	}
+	o = o.withModelTable(model)
+	group, err := o.insertGroup(model)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return noopResult{}, nil
+	}
+
+	pks, err := PickUpPK(o.Mapper(), model)
+	if err != nil {
+		return nil, err
+	}
+	if len(conflictColumns) == 0 {
+		conflictColumns = pks
+	}
+	if len(updateColumns) == 0 {
+		updateColumns = excludeColumns(group.Columns, conflictColumns, pks)
+	}
+
+	query, args, err := group.Statement.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	query, err = o.Dialect().Upsert(query, conflictColumns, updateColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.InsertX(ctx, query, args...)
+}
+
+// InsertIgnore 插入数据，忽略冲突的行
+func (o *orm) InsertIgnore(ctx context.Context, model interface{}) (sql.Result, error) {
+	return o.withModelCallbacks(ctx, model, insertCallbacks, func(ctx context.Context, o *orm) (sql.Result, error) {
+		return o.insertIgnore(ctx, model)
+	})
+}
+
+func (o *orm) insertIgnore(ctx context.Context, model interface{}) (sql.Result, error) {
+	o, err := o.shardBy(model)
+	if err != nil {
+		return nil, err
+	}
+	o = o.withModelTable(model)
+	group, err := o.insertGroup(model)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return noopResult{}, nil
+	}
+
+	query, args, err := group.Statement.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	query, err = o.Dialect().InsertIgnore(query)
 	if err != nil {
 		return nil, err
 	}
 
 	return o.InsertX(ctx, query, args...)
+}
+
+// BatchInsert 分批插入，每批的行数不超过 batchSize 并且占位符数量不超过 dialect 的限制，所有批次在同一个事务中执行
+func (o *orm) BatchInsert(ctx context.Context, models interface{}, batchSize int) (int64, error) {
+	value := reflect.Indirect(reflect.ValueOf(models))
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return 0, fmt.Errorf("[porm:orm:BatchInsert]: models must be array or slice")
+	}
+	if value.Len() == 0 {
+		return 0, nil
+	}
+
+	size, err := insertBatchSize(o.Mapper(), o.Dialect(), value.Type().Elem(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// 分片的 storage 在开启事务前从 models 中获取分片
+	so, err := o.shardBy(models)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	err = so.Transaction(ctx, func(ctx context.Context, orm *orm) error {
+		for start := 0; start < value.Len(); start += size {
+			end := start + size
+			if end > value.Len() {
+				end = value.Len()
+			}
+
+			result, err := orm.Insert(ctx, value.Slice(start, end).Interface())
+			if err != nil {
+				return err
+			}
+			affected, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			total += affected
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// insertGroups 按插入列对 model 的行分组，model 可以是结构体或者结构体列表
+func (o *orm) insertGroups(model interface{}) ([]*InsertGroup, []reflect.Value, error) {
+	value := reflect.Indirect(reflect.ValueOf(model))
+	if value.Kind() != reflect.Struct {
+		groups, err := BuilderInsertGroups(o.Mapper(), o.Dialect(), value, o.SqlBuilder().HolderType)
+		if err != nil {
+			return nil, nil, err
+		}
 
+		rows := make([]reflect.Value, value.Len())
+		for i := range rows {
+			rows[i] = reflect.Indirect(value.Index(i))
+		}
+		return groups, rows, nil
+	}
+
+	rows := []reflect.Value{value}
+	groups, err := buildInsertGroups(o.Mapper(), o.Dialect(), value.Type(), rows, o.SqlBuilder().HolderType)
+	if err != nil {
+		return nil, nil, err
+	}
+	return groups, rows, nil
+}
+
+// insertGroup 要求所有行的插入列相同，没有数据时返回 nil
+func (o *orm) insertGroup(model interface{}) (*InsertGroup, error) {
+	groups, _, err := o.insertGroups(model)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	if len(groups) > 1 {
+		return nil, fmt.Errorf("[porm:orm:insertGroup]: rows have different insert columns, first = %v, index = %d, columns = %v",
+			groups[0].Columns, groups[1].Rows[0], groups[1].Columns)
+	}
+	return groups[0], nil
 }
@@ -0,0 +1,200 @@
+package porm
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/yongpi/putil/psql"
+)
+
+// PKCond 主键条件，支持多列主键；不使用 psql.Eq，避免 [16]byte 之类的主键被当成列表展开
+type PKCond struct {
+	Columns []string
+	Values  [][]interface{}
+}
+
+func (c PKCond) ToWhere(pt psql.PlaceHolderType) (query string, args []interface{}, err error) {
+	if len(c.Columns) == 0 {
+		return "", nil, fmt.Errorf("[porm:PKCond] pk columns can not be empty")
+	}
+	if len(c.Values) == 0 {
+		return "", nil, fmt.Errorf("[porm:PKCond] pk values can not be empty")
+	}
+
+	// 单列主键使用 = 或者 IN
+	if len(c.Columns) == 1 {
+		var marks []string
+		for _, values := range c.Values {
+			if len(values) != 1 {
+				return "", nil, fmt.Errorf("[porm:PKCond] pk value size not match, columns = %v", c.Columns)
+			}
+			marks = append(marks, pt.Mark())
+			args = append(args, values[0])
+		}
+		if len(marks) == 1 {
+			return fmt.Sprintf("%s = %s", c.Columns[0], marks[0]), args, nil
+		}
+		return fmt.Sprintf("%s IN (%s)", c.Columns[0], strings.Join(marks, ",")), args, nil
+	}
+
+	var list []string
+	for _, values := range c.Values {
+		if len(values) != len(c.Columns) {
+			return "", nil, fmt.Errorf("[porm:PKCond] pk value size not match, columns = %v", c.Columns)
+		}
+		var exprs []string
+		for index, column := range c.Columns {
+			exprs = append(exprs, fmt.Sprintf("%s = %s", column, pt.Mark()))
+			args = append(args, values[index])
+		}
+		list = append(list, fmt.Sprintf("(%s)", strings.Join(exprs, " AND ")))
+	}
+	if len(list) == 1 {
+		return list[0], args, nil
+	}
+	return fmt.Sprintf("(%s)", strings.Join(list, " OR ")), args, nil
+}
+
+// BuildPKCond 根据主键值构建条件，key 可以是单个值、map[string]interface{} 或者包含主键字段的结构体
+func BuildPKCond(mapper *mapper, model interface{}, keys ...interface{}) (PKCond, error) {
+	pks, err := pickUpPKFields(mapper, model)
+	if err != nil {
+		return PKCond{}, err
+	}
+
+	cond := PKCond{Columns: fieldNames(pks)}
+	for _, key := range keys {
+		values, err := pkValues(mapper, pks, key)
+		if err != nil {
+			return PKCond{}, err
+		}
+		cond.Values = append(cond.Values, values)
+	}
+
+	return cond, nil
+}
+
+// ModelPKCond 从 model 的主键字段构建条件，value 可以是结构体或者结构体列表
+func ModelPKCond(mapper *mapper, value reflect.Value) (PKCond, error) {
+	value = reflect.Indirect(value)
+	if value.Kind() == reflect.Struct {
+		value = reflect.Append(reflect.MakeSlice(reflect.SliceOf(value.Type()), 0, 1), value)
+	}
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return PKCond{}, fmt.Errorf("[porm:ModelPKCond] model must be struct, array or slice")
+	}
+
+	pks, err := pickUpPKFields(mapper, value.Interface())
+	if err != nil {
+		return PKCond{}, err
+	}
+
+	cond := PKCond{Columns: fieldNames(pks)}
+	for i := 0; i < value.Len(); i++ {
+		ve := reflect.Indirect(value.Index(i))
+		if !ve.IsValid() {
+			return PKCond{}, fmt.Errorf("[porm:ModelPKCond] model can not be nil, index = %d", i)
+		}
+
+		values := make([]interface{}, len(pks))
+		for index, pk := range pks {
+			values[index] = CoverNullValue(ve.FieldByIndex(pk.Index).Interface())
+		}
+		cond.Values = append(cond.Values, values)
+	}
+
+	return cond, nil
+}
+
+func splitKeys(pks interface{}) ([]interface{}, error) {
+	pv := reflect.ValueOf(pks)
+	if pv.Kind() != reflect.Slice && pv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("[porm:splitKeys] pks must be array or slice")
+	}
+
+	keys := make([]interface{}, pv.Len())
+	for i := 0; i < pv.Len(); i++ {
+		keys[i] = pv.Index(i).Interface()
+	}
+	return keys, nil
+}
+
+func pkValues(mapper *mapper, pks []*FieldInfo, key interface{}) ([]interface{}, error) {
+	if data, ok := key.(map[string]interface{}); ok {
+		values := make([]interface{}, len(pks))
+		for index, pk := range pks {
+			value, ok := data[pk.Name]
+			if !ok {
+				return nil, fmt.Errorf("[porm:pkValues] pk column not found, column = %s", pk.Name)
+			}
+			values[index] = CoverNullValue(value)
+		}
+		return values, nil
+	}
+
+	kv := reflect.ValueOf(key)
+	if kv.Kind() == reflect.Ptr {
+		if kv.IsNil() {
+			return nil, fmt.Errorf("[porm:pkValues] pk value can not be nil")
+		}
+		kv = kv.Elem()
+	}
+
+	if isKeyStruct(kv) {
+		sm, err := mapper.Load(kv.Type())
+		if err != nil {
+			return nil, err
+		}
+
+		values := make([]interface{}, len(pks))
+		for index, pk := range pks {
+			field, ok := sm.ColumnMap[pk.Name]
+			if !ok {
+				return nil, fmt.Errorf("[porm:pkValues] pk column not found, column = %s, type = %s", pk.Name, kv.Type().String())
+			}
+			values[index] = CoverNullValue(kv.FieldByIndex(field.Index).Interface())
+		}
+		return values, nil
+	}
+
+	if len(pks) != 1 {
+		return nil, fmt.Errorf("[porm:pkValues] composite pk need map or struct value, columns = %v", fieldNames(pks))
+	}
+	return []interface{}{CoverNullValue(key)}, nil
+}
+
+// isKeyStruct 判断是否是由主键字段组成的结构体，driver.Valuer、NullValue 和 time.Time 当成单个值处理
+func isKeyStruct(kv reflect.Value) bool {
+	if !kv.IsValid() || kv.Kind() != reflect.Struct {
+		return false
+	}
+
+	if kv.Type() == reflect.TypeOf(time.Time{}) {
+		return false
+	}
+
+	switch kv.Interface().(type) {
+	case driver.Valuer, NullValue:
+		return false
+	}
+
+	if kv.CanAddr() {
+		switch kv.Addr().Interface().(type) {
+		case driver.Valuer, NullValue:
+			return false
+		}
+	}
+
+	return true
+}
+
+func fieldNames(fields []*FieldInfo) []string {
+	names := make([]string, len(fields))
+	for index, field := range fields {
+		names[index] = field.Name
+	}
+	return names
+}
@@ -0,0 +1,97 @@
+package porm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/yongpi/putil/psql"
+)
+
+type TestTenantM struct {
+	TenantID int64  `porm:"pk"`
+	ID       string `porm:"pk"`
+	Name     string
+}
+
+func (m *TestTenantM) TableName() string {
+	return "tenant"
+}
+
+type TestUUIDM struct {
+	ID   [16]byte `porm:"pk"`
+	Name string
+}
+
+func (m *TestUUIDM) TableName() string {
+	return "uuid"
+}
+
+func TestBuildPKCond(t *testing.T) {
+	mapper := NewMapper("test")
+
+	cond, err := BuildPKCond(mapper, &TestM{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := cond.ToWhere(psql.Question)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "id = ?" || !reflect.DeepEqual(args, []interface{}{1}) {
+		t.Errorf("single pk cond fail, query = %s, args = %v", query, args)
+	}
+
+	cond, err = BuildPKCond(mapper, &[]*TestM{}, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, _ = cond.ToWhere(psql.Question)
+	if query != "id IN (?,?)" || !reflect.DeepEqual(args, []interface{}{1, 2}) {
+		t.Errorf("multi pk cond fail, query = %s, args = %v", query, args)
+	}
+
+	var uuid [16]byte
+	uuid[0] = 1
+	cond, err = BuildPKCond(mapper, &TestUUIDM{}, uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, _ = cond.ToWhere(psql.Question)
+	if query != "id = ?" || !reflect.DeepEqual(args, []interface{}{uuid}) {
+		t.Errorf("uuid pk cond fail, query = %s, args = %v", query, args)
+	}
+}
+
+func TestBuildCompositePKCond(t *testing.T) {
+	mapper := NewMapper("test")
+
+	key := struct {
+		TenantID int64
+		ID       string
+	}{TenantID: 1, ID: "a"}
+	cond, err := BuildPKCond(mapper, &TestTenantM{}, key, map[string]interface{}{"tenant_id": 2, "id": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := cond.ToWhere(psql.Question)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "((tenant_id = ? AND id = ?) OR (tenant_id = ? AND id = ?))" || !reflect.DeepEqual(args, []interface{}{int64(1), "a", 2, "b"}) {
+		t.Errorf("composite pk cond fail, query = %s, args = %v", query, args)
+	}
+
+	_, err = BuildPKCond(mapper, &TestTenantM{}, 1)
+	if err == nil {
+		t.Errorf("composite pk with single value should fail")
+	}
+
+	cond, err = ModelPKCond(mapper, reflect.ValueOf(&TestTenantM{TenantID: 3, ID: "c", Name: "n"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, _ = cond.ToWhere(psql.Question)
+	if query != "(tenant_id = ? AND id = ?)" || !reflect.DeepEqual(args, []interface{}{int64(3), "c"}) {
+		t.Errorf("model pk cond fail, query = %s, args = %v", query, args)
+	}
+}
@@ -0,0 +1,34 @@
+package porm
+
+// noopResult 没有执行 sql 时返回的结果
+type noopResult struct{}
+
+func (noopResult) LastInsertId() (int64, error) {
+	return 0, nil
+}
+
+func (noopResult) RowsAffected() (int64, error) {
+	return 0, nil
+}
+
+// insertResult 通过 RETURNING 插入时返回的结果
+type insertResult struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func newInsertResult(ids []int64) insertResult {
+	result := insertResult{rowsAffected: int64(len(ids))}
+	if len(ids) > 0 {
+		result.lastInsertID = ids[len(ids)-1]
+	}
+	return result
+}
+
+func (r insertResult) LastInsertId() (int64, error) {
+	return r.lastInsertID, nil
+}
+
+func (r insertResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
@@ -0,0 +1,622 @@
+package porm
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yongpi/putil/psql"
+)
+
+const defaultShardTableFormat = "%s_%02d"
+
+// ShardStrategy 根据分片键返回分片的下标，shards 为分片总数
+type ShardStrategy interface {
+	Shard(key interface{}, shards int) (int, error)
+}
+
+// HashStrategy 整数的分片键直接取模，其它类型的分片键取 fnv 哈希后取模
+type HashStrategy struct{}
+
+func (HashStrategy) Shard(key interface{}, shards int) (int, error) {
+	key, err := shardKeyValue(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if value, ok := shardKeyInt(key); ok {
+		if value < 0 {
+			value = -value
+		}
+		return int(value % int64(shards)), nil
+	}
+
+	h := fnv.New64a()
+	_, _ = fmt.Fprint(h, key)
+	return int(h.Sum64() % uint64(shards)), nil
+}
+
+// RangeStrategy 按照整数分片键的范围分片，Bounds 为每个分片的上界（不包含），需要从小到大排列
+type RangeStrategy struct {
+	Bounds []int64
+}
+
+func (s RangeStrategy) Shard(key interface{}, shards int) (int, error) {
+	key, err := shardKeyValue(key)
+	if err != nil {
+		return 0, err
+	}
+
+	value, ok := shardKeyInt(key)
+	if !ok {
+		return 0, fmt.Errorf("[porm:RangeStrategy]: shard key must be integer, key = %v", key)
+	}
+
+	index := sort.Search(len(s.Bounds), func(i int) bool {
+		return value < s.Bounds[i]
+	})
+	if index >= len(s.Bounds) || index >= shards {
+		return 0, fmt.Errorf("[porm:RangeStrategy]: shard key out of range, key = %d", value)
+	}
+	return index, nil
+}
+
+// LookupStrategy 通过查表获取分片，例如从配置或者路由表中查询
+type LookupStrategy func(key interface{}) (int, error)
+
+func (s LookupStrategy) Shard(key interface{}, shards int) (int, error) {
+	return s(key)
+}
+
+// shardKeyValue 分片键实现了 driver.Valuer 时使用 Value 的结果
+func shardKeyValue(key interface{}) (interface{}, error) {
+	valuer, ok := key.(driver.Valuer)
+	if !ok {
+		return key, nil
+	}
+
+	value, err := valuer.Value()
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, fmt.Errorf("[porm:ShardStrategy]: shard key can not be null")
+	}
+	return value, nil
+}
+
+func shardKeyInt(key interface{}) (int64, bool) {
+	value := reflect.ValueOf(key)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(value.Uint()), true
+	}
+	return 0, false
+}
+
+// shardRoute 指定的分片，key 和 index 二选一
+type shardRoute struct {
+	key     interface{}
+	index   int
+	byIndex bool
+}
+
+type ShardedStorageConfig struct {
+	StorageName string
+	HolderType  psql.PlaceHolderType
+	// Shards 每个分片库的配置
+	Shards []*SimpleStorageConfig
+	// TablesPerShard 每个库中的分表数，大于 1 时表名会改写为 TableFormat 的格式，分表的下标为全局的分片下标
+	TablesPerShard int
+	// TableFormat 分表的表名格式，参数为表名和分片下标，默认为 %s_%02d
+	TableFormat string
+	// Strategy 分片策略，默认为 HashStrategy
+	Strategy ShardStrategy
+	// ShardColumn 没有通过 Shard 指定分片键时，从 model 的这个列获取分片键
+	ShardColumn string
+}
+
+// ShardedStorage 水平分片的 Storage，分片总数为库的数量乘以每个库的分表数，
+// 第 i 个分片在第 i / TablesPerShard 个库中
+type ShardedStorage struct {
+	name           string
+	shards         []*SimpleStorage
+	tablesPerShard int
+	tableFormat    string
+	strategy       ShardStrategy
+	shardColumn    string
+	sqlBuilder     psql.SqlBuilder
+	dialect        Dialect
+	hooks          *HookRegistry
+	hooksOnce      sync.Once
+}
+
+func RegisterShardedStorage(config ShardedStorageConfig) {
+	RegisterStorage(newShardedStorage(config))
+}
+
+func newShardedStorage(config ShardedStorageConfig) *ShardedStorage {
+	if len(config.Shards) == 0 {
+		panic(fmt.Errorf("[porm:RegisterShardedStorage]: shards can not be empty, storage = %s", config.StorageName))
+	}
+
+	ss := &ShardedStorage{
+		name:           config.StorageName,
+		tablesPerShard: config.TablesPerShard,
+		tableFormat:    config.TableFormat,
+		strategy:       config.Strategy,
+		shardColumn:    config.ShardColumn,
+		sqlBuilder:     psql.NewSqlBuilder(config.HolderType),
+	}
+	if ss.tablesPerShard < 1 {
+		ss.tablesPerShard = 1
+	}
+	if ss.tableFormat == "" {
+		ss.tableFormat = defaultShardTableFormat
+	}
+	if ss.strategy == nil {
+		ss.strategy = HashStrategy{}
+	}
+
+	for _, cf := range config.Shards {
+		db, err := OpenDBName(cf.DriverName, cf.DataSourceName, config.StorageName)
+		if err != nil {
+			panic(err)
+		}
+		ss.shards = append(ss.shards, &SimpleStorage{db: db, Name: config.StorageName, dialect: cf.dialect()})
+	}
+	ss.dialect = ss.shards[0].dialect
+	return ss
+}
+
+func (s *ShardedStorage) Hooks() *HookRegistry {
+	s.hooksOnce.Do(func() {
+		s.hooks = NewHookRegistry()
+	})
+	return s.hooks
+}
+
+// GetDB 返回 orm 指定的分片所在的库，没有指定分片时返回 nil
+func (s *ShardedStorage) GetDB(orm *orm) *DB {
+	db, err := s.shardDB(orm.shard)
+	if err != nil {
+		return nil
+	}
+	return db
+}
+
+func (s *ShardedStorage) GetName() string {
+	return s.name
+}
+
+func (s *ShardedStorage) SqlBuilder() psql.SqlBuilder {
+	return s.sqlBuilder
+}
+
+func (s *ShardedStorage) GetMapper() *mapper {
+	return s.shards[0].GetMapper()
+}
+
+func (s *ShardedStorage) Dialect() Dialect {
+	return s.dialect
+}
+
+// ShardCount 分片总数
+func (s *ShardedStorage) ShardCount() int {
+	return len(s.shards) * s.tablesPerShard
+}
+
+// ShardTable 返回第 index 个分片中的表名，没有分表时不改写
+func (s *ShardedStorage) ShardTable(table string, index int) string {
+	if s.tablesPerShard <= 1 {
+		return table
+	}
+	return fmt.Sprintf(s.tableFormat, table, index)
+}
+
+func (s *ShardedStorage) shardIndex(route *shardRoute) (int, error) {
+	if route == nil {
+		return 0, fmt.Errorf("[porm:ShardedStorage]: shard not specified, use Shard or set ShardColumn, storage = %s", s.name)
+	}
+
+	index := route.index
+	if !route.byIndex {
+		var err error
+		index, err = s.strategy.Shard(route.key, s.ShardCount())
+		if err != nil {
+			return 0, err
+		}
+	}
+	if index < 0 || index >= s.ShardCount() {
+		return 0, fmt.Errorf("[porm:ShardedStorage]: shard index out of range, index = %d, storage = %s", index, s.name)
+	}
+	return index, nil
+}
+
+func (s *ShardedStorage) shardDB(route *shardRoute) (*DB, error) {
+	index, err := s.shardIndex(route)
+	if err != nil {
+		return nil, err
+	}
+	return s.shards[index/s.tablesPerShard].db, nil
+}
+
+// modelRoute 从 model 的 ShardColumn 获取分片，model 为 slice 时所有的行必须在同一个分片
+func (s *ShardedStorage) modelRoute(mapper *mapper, model interface{}) (*shardRoute, error) {
+	if s.shardColumn == "" {
+		return nil, nil
+	}
+
+	mv := reflect.Indirect(reflect.ValueOf(model))
+	rows := []reflect.Value{mv}
+	if mv.Kind() == reflect.Slice || mv.Kind() == reflect.Array {
+		rows = rows[:0]
+		for i := 0; i < mv.Len(); i++ {
+			rows = append(rows, reflect.Indirect(mv.Index(i)))
+		}
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	route := &shardRoute{byIndex: true}
+	for i, row := range rows {
+		sm, err := mapper.Load(row.Type())
+		if err != nil {
+			return nil, err
+		}
+		field, ok := sm.ColumnMap[s.shardColumn]
+		if !ok {
+			return nil, fmt.Errorf("[porm:ShardedStorage]: shard column not found, column = %s", s.shardColumn)
+		}
+
+		index, err := s.shardIndex(&shardRoute{key: row.FieldByIndex(field.Index).Interface()})
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && index != route.index {
+			return nil, fmt.Errorf("[porm:ShardedStorage]: rows in different shards, shards = %d, %d", route.index, index)
+		}
+		route.index = index
+	}
+	return route, nil
+}
+
+// Shard 指定分片键，返回的 orm 只访问分片键所在的分片
+func (o *orm) Shard(key interface{}) *orm {
+	no := o.session()
+	no.shard = &shardRoute{key: key}
+	return no
+}
+
+// onShard 指定分片的下标，查询所有分片时使用
+func (o *orm) onShard(index int) *orm {
+	no := o.session()
+	no.shard = &shardRoute{index: index, byIndex: true}
+	return no
+}
+
+// shardCount 分片的 storage 并且没有指定分片时返回分片总数，需要查询所有分片
+func (o *orm) shardCount() int {
+	ss, ok := o.storage.(*ShardedStorage)
+	if !ok || o.shard != nil {
+		return 0
+	}
+	return ss.ShardCount()
+}
+
+// shardBy 分片的 storage 没有指定分片时从 model 中获取分片
+func (o *orm) shardBy(model interface{}) (*orm, error) {
+	ss, ok := o.storage.(*ShardedStorage)
+	if !ok || o.shard != nil {
+		return o, nil
+	}
+
+	route, err := ss.modelRoute(o.Mapper(), model)
+	if err != nil {
+		return nil, err
+	}
+	no := o.session()
+	no.shard = route
+	return no, nil
+}
+
+// resolveDB 返回执行使用的 db，分片的 storage 没有指定分片时返回错误
+func (o *orm) resolveDB() (*DB, error) {
+	if o.db != nil {
+		return o.db, nil
+	}
+	if ss, ok := o.storage.(*ShardedStorage); ok {
+		return ss.shardDB(o.shard)
+	}
+	return o.DB(), nil
+}
+
+// routeShard 分表时把 sql 中的表名改写为分片中的表名
+func (o *orm) routeShard(op *Operation) error {
+	ss, ok := o.storage.(*ShardedStorage)
+	if !ok {
+		return nil
+	}
+
+	index, err := ss.shardIndex(o.shard)
+	if err != nil {
+		return err
+	}
+	if o.table == "" || ss.tablesPerShard <= 1 {
+		return nil
+	}
+
+	quoted := quoteIdent(o.Dialect(), o.table)
+	re, err := regexp.Compile(`(?i)\b(FROM|INTO|UPDATE|JOIN)(\s+)(` + regexp.QuoteMeta(quoted) + `|` + regexp.QuoteMeta(o.table) + `\b)`)
+	if err != nil {
+		return err
+	}
+	table := quoteIdent(o.Dialect(), ss.ShardTable(o.table, index))
+	op.Query = re.ReplaceAllString(op.Query, "${1}${2}"+strings.ReplaceAll(table, "$", "$$"))
+	return nil
+}
+
+// sameShardDB 分片的 storage 只能在事务所在的库中使用事务，没有指定分片时不判断
+func (o *orm) sameShardDB(t *transaction) bool {
+	ss, ok := o.storage.(*ShardedStorage)
+	if !ok || t == nil || t.db == nil {
+		return true
+	}
+
+	db, err := ss.shardDB(o.shard)
+	return err != nil || db == t.db
+}
+
+func (o *orm) shardTxError() error {
+	return fmt.Errorf("[porm:orm]: shard is not in the db of tx, storage = %s", o.StorageName())
+}
+
+// shardOrder 合并分片结果时使用的排序列
+type shardOrder struct {
+	index []int
+	desc  bool
+}
+
+// selectShards 查询所有分片并合并结果：每个分片查询 LIMIT offset+limit 条，合并后按 ORDER BY 重新排序，再取 OFFSET、LIMIT；
+// ORDER BY 只支持 model 中的列，NULL 排在最前面
+func (o *orm) selectShards(ctx context.Context, st *psql.SelectStatement, model interface{}, n int) error {
+	dv := reflect.Indirect(reflect.ValueOf(model))
+	if dv.Kind() != reflect.Slice || !dv.CanSet() {
+		return fmt.Errorf("[porm:orm:Select] model must be pointer of slice when select all shards, use Shard to select one shard")
+	}
+
+	orders, err := o.shardOrders(st, dv.Type().Elem())
+	if err != nil {
+		return err
+	}
+
+	cst := *st
+	cst.OffsetValue = nil
+	if st.LimitValue != nil && st.OffsetValue != nil {
+		limit := *st.LimitValue + *st.OffsetValue
+		cst.LimitValue = &limit
+	}
+
+	// 合并前的结果不记录快照，只记录最终返回的行
+	rows := reflect.New(dv.Type())
+	sctx := context.WithValue(ctx, trackerKey, (*tracker)(nil))
+	for index := 0; index < n; index++ {
+		sst := cst
+		if err = o.onShard(index).WithStatement(&sst).Select(sctx, rows.Interface()); err != nil {
+			return err
+		}
+	}
+
+	list := rows.Elem()
+	if len(orders) > 0 {
+		sort.SliceStable(list.Interface(), func(i, j int) bool {
+			return lessShardRow(list.Index(i), list.Index(j), orders)
+		})
+	}
+
+	start, end := 0, list.Len()
+	if st.OffsetValue != nil {
+		start = min(int(*st.OffsetValue), end)
+	}
+	if st.LimitValue != nil {
+		end = min(start+int(*st.LimitValue), end)
+	}
+
+	tk := trackerFrom(ctx)
+	moved := tk.watch(model)
+	size := dv.Len()
+	dv.Set(reflect.AppendSlice(dv, list.Slice(start, end)))
+	moved()
+	if tk == nil {
+		return nil
+	}
+
+	for i := size; i < dv.Len(); i++ {
+		ptr := dv.Index(i)
+		if ptr.Kind() != reflect.Ptr {
+			ptr = ptr.Addr()
+		}
+		if err = tk.snapshot(o.Mapper(), ptr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardOrders 解析 ORDER BY，只支持 "列名 [ASC|DESC]" 的格式
+func (o *orm) shardOrders(st *psql.SelectStatement, elem reflect.Type) ([]shardOrder, error) {
+	if len(st.OrderBys) == 0 {
+		return nil, nil
+	}
+
+	for elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	sm, err := o.Mapper().Load(elem)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]bool)
+	all := len(st.Columns) == 0 || st.Columns[0] == "*"
+	for _, column := range st.Columns {
+		selected[unquoteIdent(column)] = true
+	}
+
+	var orders []shardOrder
+	for _, orderBy := range st.OrderBys {
+		query, args, err := orderBy.ToWhere(o.SqlBuilder().HolderType)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) > 0 {
+			return nil, fmt.Errorf("[porm:orm:Select] order by with args is not supported when select all shards, order by = %s", query)
+		}
+
+		for _, term := range strings.Split(query, ",") {
+			fields := strings.Fields(term)
+			if len(fields) == 0 || len(fields) > 2 {
+				return nil, fmt.Errorf("[porm:orm:Select] order by is not supported when select all shards, order by = %s", term)
+			}
+
+			order := shardOrder{}
+			if len(fields) == 2 {
+				switch strings.ToUpper(fields[1]) {
+				case "ASC":
+				case "DESC":
+					order.desc = true
+				default:
+					return nil, fmt.Errorf("[porm:orm:Select] order by is not supported when select all shards, order by = %s", term)
+				}
+			}
+
+			name := unquoteIdent(fields[0])
+			field, ok := sm.ColumnMap[name]
+			if !ok || (!all && !selected[name]) {
+				return nil, fmt.Errorf("[porm:orm:Select] order by column must be selected column of model when select all shards, column = %s", name)
+			}
+			order.index = field.Index
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+// unquoteIdent 去掉列名的表名前缀和引号
+func unquoteIdent(identifier string) string {
+	if index := strings.LastIndex(identifier, "."); index >= 0 {
+		identifier = identifier[index+1:]
+	}
+	return strings.Trim(identifier, "`\"")
+}
+
+func lessShardRow(a, b reflect.Value, orders []shardOrder) bool {
+	a, b = reflect.Indirect(a), reflect.Indirect(b)
+	for _, order := range orders {
+		result := compareShardValue(a.FieldByIndex(order.index), b.FieldByIndex(order.index))
+		if result == 0 {
+			continue
+		}
+		if order.desc {
+			return result > 0
+		}
+		return result < 0
+	}
+	return false
+}
+
+// compareShardValue 按照数据库中的值比较，实现了 driver.Valuer 的类型使用 Value 的结果
+func compareShardValue(a, b reflect.Value) int {
+	av, bv := shardSortValue(a), shardSortValue(b)
+	switch {
+	case av == nil && bv == nil:
+		return 0
+	case av == nil:
+		return -1
+	case bv == nil:
+		return 1
+	}
+
+	switch x := av.(type) {
+	case int64:
+		if y, ok := bv.(int64); ok {
+			return cmp.Compare(x, y)
+		}
+	case uint64:
+		if y, ok := bv.(uint64); ok {
+			return cmp.Compare(x, y)
+		}
+	case float64:
+		if y, ok := bv.(float64); ok {
+			return cmp.Compare(x, y)
+		}
+	case string:
+		if y, ok := bv.(string); ok {
+			return strings.Compare(x, y)
+		}
+	case []byte:
+		if y, ok := bv.([]byte); ok {
+			return bytes.Compare(x, y)
+		}
+	case bool:
+		if y, ok := bv.(bool); ok && x != y {
+			if x {
+				return 1
+			}
+			return -1
+		}
+		return 0
+	case time.Time:
+		if y, ok := bv.(time.Time); ok {
+			return x.Compare(y)
+		}
+	}
+	return strings.Compare(fmt.Sprint(av), fmt.Sprint(bv))
+}
+
+// shardSortValue 返回用于比较的值，NULL 返回 nil
+func shardSortValue(value reflect.Value) interface{} {
+	if valuer, ok := value.Interface().(driver.Valuer); ok {
+		if value.Kind() == reflect.Ptr && value.IsNil() {
+			return nil
+		}
+		v, err := valuer.Value()
+		if err != nil || v == nil {
+			return nil
+		}
+		value = reflect.ValueOf(v)
+	}
+
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return value.Uint()
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	case reflect.String:
+		return value.String()
+	case reflect.Bool:
+		return value.Bool()
+	}
+	return value.Interface()
+}
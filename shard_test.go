@@ -0,0 +1,274 @@
+package porm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yongpi/putil/psql"
+)
+
+func TestShardStrategy(t *testing.T) {
+	var hash HashStrategy
+	for key, want := range map[interface{}]int{int64(7): 3, 4: 0, int32(-5): 1, uint(10): 2} {
+		if index, err := hash.Shard(key, 4); err != nil || index != want {
+			t.Errorf("hash shard fail, key = %v, index = %d, err = %v", key, index, err)
+		}
+	}
+	var member NullInt64
+	member.SetInt64(6)
+	if index, err := hash.Shard(member, 4); err != nil || index != 2 {
+		t.Errorf("hash shard valuer fail, index = %d, err = %v", index, err)
+	}
+	first, _ := hash.Shard("user_a", 4)
+	second, _ := hash.Shard("user_a", 4)
+	if first != second || first < 0 || first >= 4 {
+		t.Errorf("hash shard string fail, index = %d, %d", first, second)
+	}
+
+	ranges := RangeStrategy{Bounds: []int64{100, 200}}
+	for key, want := range map[int64]int{0: 0, 99: 0, 100: 1, 199: 1} {
+		if index, err := ranges.Shard(key, 2); err != nil || index != want {
+			t.Errorf("range shard fail, key = %d, index = %d, err = %v", key, index, err)
+		}
+	}
+	if _, err := ranges.Shard(int64(200), 2); err == nil {
+		t.Errorf("range shard out of range should fail")
+	}
+	if _, err := ranges.Shard("a", 2); err == nil {
+		t.Errorf("range shard string key should fail")
+	}
+
+	table := map[string]int{"cn": 0, "us": 1}
+	lookup := LookupStrategy(func(key interface{}) (int, error) {
+		index, ok := table[fmt.Sprint(key)]
+		if !ok {
+			return 0, fmt.Errorf("region not found, key = %v", key)
+		}
+		return index, nil
+	})
+	if index, err := lookup.Shard("us", 2); err != nil || index != 1 {
+		t.Errorf("lookup shard fail, index = %d, err = %v", index, err)
+	}
+}
+
+// shardedORM 两个库，每个库两张分表，order_00、order_01 在第一个库，order_02、order_03 在第二个库
+func shardedORM(t *testing.T, storageName string) (*orm, []string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	dsns := []string{filepath.Join(dir, "shard_0.db"), filepath.Join(dir, "shard_1.db")}
+	config := ShardedStorageConfig{StorageName: storageName, TablesPerShard: 2, ShardColumn: "id"}
+	for index, dsn := range dsns {
+		for i := 0; i < 2; i++ {
+			execSQLite(t, dsn, fmt.Sprintf(`CREATE TABLE "order_%02d" (id INTEGER PRIMARY KEY AUTOINCREMENT, "group" TEXT NOT NULL DEFAULT '')`, index*2+i))
+		}
+		config.Shards = append(config.Shards, &SimpleStorageConfig{DriverName: "sqlite3", DataSourceName: dsn})
+	}
+
+	return &orm{storage: newShardedStorage(config)}, dsns
+}
+
+func countShardTable(t *testing.T, dsn string, table string) int {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	var count int
+	if err = db.QueryRow(fmt.Sprintf(`SELECT COUNT(1) FROM "%s"`, table)).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func orderIDs(list []*TestOrderM) []int64 {
+	ids := make([]int64, len(list))
+	for index, m := range list {
+		ids[index] = m.ID
+	}
+	return ids
+}
+
+func TestShardedStorage(t *testing.T) {
+	o, dsns := shardedORM(t, "sqlite_sharded")
+	ctx := context.Background()
+
+	// 从 model 的 id 获取分片
+	for id := int64(4); id < 8; id++ {
+		if _, err := o.Insert(ctx, &TestOrderM{ID: id, Group: fmt.Sprint("g", id)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := o.Insert(ctx, []*TestOrderM{{ID: 9}, {ID: 13}}); err != nil {
+		t.Fatal(err)
+	}
+	for index, want := range []int{1, 3, 1, 1} {
+		dsn, table := dsns[index/2], fmt.Sprintf("order_%02d", index)
+		if count := countShardTable(t, dsn, table); count != want {
+			t.Errorf("insert route fail, table = %s, count = %d", table, count)
+		}
+	}
+
+	// 同一批插入的行必须在同一个分片
+	if _, err := o.Insert(ctx, []*TestOrderM{{ID: 10}, {ID: 11}}); err == nil {
+		t.Errorf("insert rows in different shards should fail")
+	}
+
+	// 批量插入从 model 中获取分片
+	if total, err := o.BatchInsert(ctx, []*TestOrderM{{ID: 16}, {ID: 20}, {ID: 24}}, 2); err != nil || total != 3 {
+		t.Fatalf("batch insert shard fail, total = %d, err = %v", total, err)
+	}
+	if count := countShardTable(t, dsns[0], "order_00"); count != 4 {
+		t.Errorf("batch insert route fail, count = %d", count)
+	}
+	if _, err := o.BatchInsert(ctx, []*TestOrderM{{ID: 10}, {ID: 11}}, 2); err == nil {
+		t.Errorf("batch insert rows in different shards should fail")
+	}
+	if _, err := o.Shard(16).DeleteByPKs(ctx, []int64{16, 20, 24}, &TestOrderM{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 指定分片
+	list, err := Find[*TestOrderM](ctx, o.Shard(6), psql.Select("*").Where(psql.Eq{"id": 6}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Group != "g6" {
+		t.Errorf("select shard fail, list = %+v", list)
+	}
+
+	// 查询所有分片，合并后重新排序
+	list, err = Find[*TestOrderM](ctx, o, psql.Select("*").OrderBy("id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := orderIDs(list); !reflect.DeepEqual(ids, []int64{4, 5, 6, 7, 9, 13}) {
+		t.Errorf("select all shards fail, ids = %v", ids)
+	}
+	list, err = Find[*TestOrderM](ctx, o, psql.Select("*").OrderBy(`"id" DESC`).Limit(3).Offset(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := orderIDs(list); !reflect.DeepEqual(ids, []int64{9, 7, 6}) {
+		t.Errorf("select all shards with limit fail, ids = %v", ids)
+	}
+	var values []TestOrderM
+	if err = o.WithStatement(psql.Select("*").OrderBy(`"group" DESC, id`).Offset(4)).Select(ctx, &values); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0].ID != 9 || values[1].ID != 13 {
+		t.Errorf("select all shards with offset fail, values = %+v", values)
+	}
+	// 只记录合并后返回的行
+	tctx := WithTracking(ctx)
+	if list, err = Find[*TestOrderM](tctx, o, psql.Select("*").OrderBy("id").Limit(2)); err != nil {
+		t.Fatal(err)
+	}
+	if size := len(trackerFrom(tctx).snapshots); size != 2 {
+		t.Errorf("select all shards tracking fail, snapshots = %d", size)
+	}
+	sm, err := o.Mapper().Load(TestOrderM{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := trackerFrom(tctx).changed(sm, reflect.ValueOf(list[0])); !ok {
+		t.Errorf("select all shards should track returned rows")
+	}
+	if _, err = Find[*TestOrderM](ctx, o, psql.Select("*").OrderBy(`LENGTH("group")`)); err == nil {
+		t.Errorf("select all shards with expression order by should fail")
+	}
+	if _, err = Find[*TestOrderM](ctx, o, psql.Select(`"group"`).OrderBy("id")); err == nil {
+		t.Errorf("select all shards order by unselected column should fail")
+	}
+
+	var count int64
+	list = nil
+	if err = o.WithStatement(psql.Select("*").OrderBy("id").Limit(2)).SelectWithCount(ctx, &list, &count); err != nil {
+		t.Fatal(err)
+	}
+	if ids := orderIDs(list); count != 6 || !reflect.DeepEqual(ids, []int64{4, 5}) {
+		t.Errorf("count all shards fail, count = %d, ids = %v", count, ids)
+	}
+	if err = o.WithStatement(psql.Select("*")).Select(ctx, &TestOrderM{}); err == nil {
+		t.Errorf("select all shards into struct should fail")
+	}
+
+	if _, err = o.UpdateModel(ctx, &TestOrderM{ID: 5, Group: "updated"}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := First[*TestOrderM](ctx, o.Shard(5), psql.Select("*").Where(psql.Eq{"id": 5}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Group != "updated" {
+		t.Errorf("update shard fail, m = %+v", m)
+	}
+
+	if _, err = o.DeleteModel(ctx, &TestOrderM{ID: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if count := countShardTable(t, dsns[0], "order_01"); count != 2 {
+		t.Errorf("delete shard fail, count = %d", count)
+	}
+
+	// 没有表名的 sql 需要指定分片
+	if _, err = o.SelectX(ctx, `SELECT * FROM "order_00"`); err == nil {
+		t.Errorf("select without shard should fail")
+	}
+	rows, err := o.Shard(4).SelectX(ctx, `SELECT * FROM "order_00"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rows.Close()
+}
+
+func TestShardedTransaction(t *testing.T) {
+	o, dsns := shardedORM(t, "sqlite_sharded_tx")
+	ctx := context.Background()
+
+	if _, err := o.Insert(ctx, &TestOrderM{ID: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := errors.New("stop")
+	err := o.Shard(1).Transaction(ctx, func(ctx context.Context, to *orm) error {
+		// 同一个库的分片加入事务
+		if _, err := o.Insert(ctx, &TestOrderM{ID: 4}); err != nil {
+			return err
+		}
+		// 其它库的分片不能在事务外写入
+		if _, err := o.Insert(ctx, &TestOrderM{ID: 6}); err == nil {
+			t.Error("insert shard in other db should fail")
+		}
+		if _, err := to.Shard(6).Insert(ctx, &TestOrderM{ID: 6}); err == nil {
+			t.Error("insert shard in other db with tx orm should fail")
+		}
+		// 其它库的分片可以读
+		list, err := Find[*TestOrderM](ctx, to.Shard(7), psql.Select("*"))
+		if err != nil {
+			return err
+		}
+		if len(list) != 1 || list[0].ID != 7 {
+			t.Errorf("select shard in other db fail, list = %+v", list)
+		}
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("tx should return error, err = %v", err)
+	}
+
+	if count := countShardTable(t, dsns[0], "order_00"); count != 0 {
+		t.Errorf("shard in tx db should roll back, count = %d", count)
+	}
+	if count := countShardTable(t, dsns[1], "order_02"); count != 0 {
+		t.Errorf("shard in other db should not be written, count = %d", count)
+	}
+}
@@ -3,6 +3,7 @@ package porm
 import (
 	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/yongpi/putil/psql"
 )
@@ -55,84 +56,236 @@ func BuilderInsertOne(mapper *mapper, st *psql.InsertStatement, value reflect.Va
 	if err != nil {
 		return err
 	}
-	var values []interface{}
-	for _, column := range sm.Columns {
-		if column.ReadOnly {
-			continue
-		}
-		cv := value.FieldByIndex(column.Index)
-		if column.PK {
-			if !cv.IsValid() || cv.IsZero() {
-				continue
-			}
-		}
 
-		st.Column(column.Name)
-		values = append(values, CoverNullValue(cv.Interface()))
-	}
-	st.Value(values...)
+	columns := insertColumns(sm, value)
+	st.Column(fieldNames(columns)...)
+	st.Value(insertValues(columns, value)...)
 	return nil
 }
 
+// BuilderInsertList 批量插入的每一行必须有相同的插入列，否则使用 BuilderInsertGroups
 func BuilderInsertList(mapper *mapper, st *psql.InsertStatement, value reflect.Value) error {
+	groups, err := BuilderInsertGroups(mapper, nil, value, st.HolderType)
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		return fmt.Errorf("[porm:BuilderInsertList] model can not be empty")
+	}
+	if len(groups) > 1 {
+		return fmt.Errorf("[porm:BuilderInsertList] rows have different insert columns, first = %v, index = %d, columns = %v",
+			groups[0].Columns, groups[1].Rows[0], groups[1].Columns)
+	}
+
+	group := groups[0].Statement
+	st.Table(group.TableName)
+	st.Column(group.Columns...)
+	st.Values = append(st.Values, group.Values...)
+	return nil
+}
+
+// InsertGroup 插入列相同的行，Columns 为没有加引号的插入列，Rows 为行在原列表中的下标
+type InsertGroup struct {
+	Statement *psql.InsertStatement
+	Columns   []string
+	Rows      []int
+}
+
+// BuilderInsertGroups 按插入列对行分组，零值的主键和 default 列不插入，交给数据库生成。dialect 不为空时表名和列名会加上引号
+func BuilderInsertGroups(mapper *mapper, dialect Dialect, value reflect.Value, holderType psql.PlaceHolderType) ([]*InsertGroup, error) {
 	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
-		return fmt.Errorf("[porm:BuilderInsertList] model must be array or slice")
+		return nil, fmt.Errorf("[porm:BuilderInsertGroups] model must be array or slice")
+	}
+
+	rows := make([]reflect.Value, value.Len())
+	for i := 0; i < value.Len(); i++ {
+		rows[i] = reflect.Indirect(value.Index(i))
+		if !rows[i].IsValid() {
+			return nil, fmt.Errorf("[porm:BuilderInsertGroups] model can not be nil, index = %d", i)
+		}
 	}
 
 	met := value.Type().Elem()
 	if met.Kind() == reflect.Ptr {
 		met = met.Elem()
 	}
+	return buildInsertGroups(mapper, dialect, met, rows, holderType)
+}
 
+func buildInsertGroups(mapper *mapper, dialect Dialect, met reflect.Type, rows []reflect.Value, holderType psql.PlaceHolderType) ([]*InsertGroup, error) {
 	table, ok := reflect.New(met).Interface().(Model)
 	if !ok {
-		return fmt.Errorf("[porm:BuilderInsertList] model must implement Model interface")
+		return nil, fmt.Errorf("[porm:BuilderInsertGroups] model must implement Model interface")
 	}
 
-	st.Table(table.TableName())
 	sm, err := mapper.Load(met)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var (
-		fi      []interface{}
-		columns []string
-	)
-	first := reflect.Indirect(value.Index(0))
+	var groups []*InsertGroup
+	groupMap := make(map[string]*InsertGroup)
+	for index, row := range rows {
+		columns := insertColumns(sm, row)
+		names := fieldNames(columns)
+		key := strings.Join(names, ",")
 
+		group, ok := groupMap[key]
+		if !ok {
+			st := psql.NewInsert(holderType).Table(quoteIdent(dialect, table.TableName())).Column(quoteColumns(dialect, names)...)
+			group = &InsertGroup{Statement: st, Columns: names}
+			groupMap[key] = group
+			groups = append(groups, group)
+		}
+
+		group.Statement.Value(insertValues(columns, row)...)
+		group.Rows = append(group.Rows, index)
+	}
+
+	return groups, nil
+}
+
+// insertColumns 返回一行需要插入的列，readonly 列不插入，主键和 default 列为零值时不插入
+func insertColumns(sm StructMapper, value reflect.Value) []*FieldInfo {
+	var columns []*FieldInfo
 	for _, column := range sm.Columns {
 		if column.ReadOnly {
 			continue
 		}
-		cv := first.FieldByIndex(column.Index)
-		if column.PK {
+		if column.PK || column.Default {
+			cv := value.FieldByIndex(column.Index)
 			if !cv.IsValid() || cv.IsZero() {
 				continue
 			}
 		}
 
-		columns = append(columns, column.Name)
-		fi = append(fi, CoverNullValue(cv.Interface()))
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+func insertValues(columns []*FieldInfo, value reflect.Value) []interface{} {
+	values := make([]interface{}, len(columns))
+	for index, column := range columns {
+		values[index] = CoverNullValue(value.FieldByIndex(column.Index).Interface())
+	}
+	return values
+}
+
+// BuilderUpdateModel 根据 model 构建 update 语句，dialect 不为空时列名会加上引号
+func BuilderUpdateModel(mapper *mapper, dialect Dialect, st *psql.UpdateStatement, value reflect.Value, options ...UpdateOption) error {
+	sm, err := mapper.Load(value.Type())
+	if err != nil {
+		return err
+	}
+	opts, err := newUpdateOptions(sm, options)
+	if err != nil {
+		return err
+	}
+	cond, err := ModelPKCond(mapper, value)
+	if err != nil {
+		return err
+	}
+	cond.Columns = quoteColumns(dialect, cond.Columns)
+
+	st.Where(cond)
+	for _, column := range sm.Columns {
+		if column.PK || column.ReadOnly || opts.skip(column) {
+			continue
+		}
+		cv := value.FieldByIndex(column.Index)
+		if opts.nonZero && cv.IsZero() {
+			continue
+		}
+		st.Set(quoteIdent(dialect, column.Name), CoverNullValue(cv.Interface()))
+	}
+
+	return nil
+}
+
+// pickUpGeneratedPK 返回需要回填的自增主键，只有单个整数主键并且没有出现在插入列中时才回填
+func pickUpGeneratedPK(mapper *mapper, rows []reflect.Value, columns []string) (*FieldInfo, error) {
+	if len(rows) == 0 {
+		return nil, nil
 	}
-	st.Value(fi...)
 
-	st.Column(columns...)
+	sm, err := mapper.Load(rows[0].Type())
+	if err != nil {
+		return nil, err
+	}
+	if len(sm.PKs) != 1 {
+		return nil, nil
+	}
 
-	for i := 1; i < value.Len(); i++ {
-		ve := reflect.Indirect(value.Index(i))
-		vi := make([]interface{}, len(columns))
+	pk := sm.PKs[0]
+	for _, column := range columns {
+		if column == pk.Name {
+			return nil, nil
+		}
+	}
 
-		for index, key := range columns {
-			column := sm.ColumnMap[key]
-			vi[index] = CoverNullValue(ve.FieldByIndex(column.Index).Interface())
+	for _, row := range rows {
+		if !isIntegerKind(row.FieldByIndex(pk.Index).Kind()) || !row.CanSet() {
+			return nil, nil
 		}
-		st.Value(vi...)
 	}
 
+	return pk, nil
+}
+
+func fillGeneratedPK(pk *FieldInfo, rows []reflect.Value, ids []int64) error {
+	if len(ids) != len(rows) {
+		return fmt.Errorf("[porm:fillGeneratedPK] generated pk size not match, rows = %d, ids = %d", len(rows), len(ids))
+	}
+
+	for index, row := range rows {
+		field := row.FieldByIndex(pk.Index)
+		switch field.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			field.SetInt(ids[index])
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			field.SetUint(uint64(ids[index]))
+		}
+	}
 	return nil
 }
 
+func isIntegerKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// insertBatchSize 计算每批插入的行数，batchSize <= 0 时只受 dialect 的占位符数量限制
+func insertBatchSize(mapper *mapper, dialect Dialect, elem reflect.Type, batchSize int) (int, error) {
+	if elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	sm, err := mapper.Load(elem)
+	if err != nil {
+		return 0, err
+	}
+
+	var columns int
+	for _, column := range sm.Columns {
+		if !column.ReadOnly {
+			columns++
+		}
+	}
+	if columns == 0 {
+		return 0, fmt.Errorf("[porm:insertBatchSize] struct has not insert column, type = %s", elem.String())
+	}
+
+	size := dialect.MaxPlaceholders() / columns
+	if batchSize > 0 && batchSize < size {
+		size = batchSize
+	}
+	return size, nil
+}
+
 func FillUpdate(st *psql.UpdateStatement, model interface{}, holderType psql.PlaceHolderType) error {
 	if st.TableName == "" {
 		tableName, err := PickUpTable(model)
@@ -180,42 +333,38 @@ func PickUpColumns(mapper *mapper, model interface{}) ([]string, error) {
 	return mapper.Columns(met)
 }
 
-func PickUpPK(mapper *mapper, model interface{}) (string, error) {
-	mv := reflect.Indirect(reflect.ValueOf(model))
-	if mv.Kind() == reflect.Struct {
-		vt, err := mapper.Load(mv.Type())
-		if err != nil {
-			return "", err
-		}
-
-		for _, column := range vt.Columns {
-			if column.PK {
-				return column.Name, nil
-			}
-		}
-		return "", fmt.Errorf("struct has not pk, type = %s", mv.Type().String())
+func PickUpPK(mapper *mapper, model interface{}) ([]string, error) {
+	pks, err := pickUpPKFields(mapper, model)
+	if err != nil {
+		return nil, err
 	}
 
-	if mv.Kind() != reflect.Slice && mv.Kind() != reflect.Array {
-		return "", fmt.Errorf("[porm:fillList] model must be array or slice")
-	}
+	return fieldNames(pks), nil
+}
 
-	met := mv.Type().Elem()
-	if met.Kind() == reflect.Ptr {
+func pickUpPKFields(mapper *mapper, model interface{}) ([]*FieldInfo, error) {
+	mv := reflect.Indirect(reflect.ValueOf(model))
+	met := mv.Type()
+	if mv.Kind() == reflect.Slice || mv.Kind() == reflect.Array {
 		met = met.Elem()
+		if met.Kind() == reflect.Ptr {
+			met = met.Elem()
+		}
+	}
+
+	if met.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("[porm:PickUpPK] model must be struct, array or slice")
 	}
 
 	vt, err := mapper.Load(met)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	for _, column := range vt.Columns {
-		if column.PK {
-			return column.Name, nil
-		}
+	if len(vt.PKs) == 0 {
+		return nil, fmt.Errorf("struct has not pk, type = %s", met.String())
 	}
-	return "", fmt.Errorf("struct has not pk, type = %s", met.String())
+	return vt.PKs, nil
 }
 
 func PickUpTable(model interface{}) (string, error) {
@@ -0,0 +1,166 @@
+package porm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/yongpi/putil/psql"
+)
+
+func TestBuilderUpdateModel(t *testing.T) {
+	mapper := NewMapper("test")
+	m := TestM{Description: "d", ID: 1, Zone: "z"}
+	m.Name = "n"
+
+	st := psql.Update("test")
+	err := BuilderUpdateModel(mapper, nil, st, reflect.ValueOf(m), Columns("zone", "name"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := st.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "UPDATE test SET zone=?,name=? WHERE id = ?" || !reflect.DeepEqual(args, []interface{}{"z", "n", 1}) {
+		t.Errorf("update columns fail, query = %s, args = %v", query, args)
+	}
+
+	st = psql.Update("test")
+	err = BuilderUpdateModel(mapper, nil, st, reflect.ValueOf(m), NonZero(), Omit("description"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, _ = st.ToSql()
+	if query != "UPDATE test SET zone=?,name=? WHERE id = ?" || !reflect.DeepEqual(args, []interface{}{"z", "n", 1}) {
+		t.Errorf("update non zero fail, query = %s, args = %v", query, args)
+	}
+
+	st = psql.Update("test")
+	err = BuilderUpdateModel(mapper, nil, st, reflect.ValueOf(m), Columns("description"), onlyChanged(map[string]bool{"zone": true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Sets) != 0 {
+		t.Errorf("update changed fail, sets = %v", st.Sets)
+	}
+
+	err = BuilderUpdateModel(mapper, nil, psql.Update("test"), reflect.ValueOf(m), Columns("basicla"))
+	if err == nil {
+		t.Errorf("update readonly column should fail")
+	}
+
+	err = BuilderUpdateModel(mapper, nil, psql.Update("test"), reflect.ValueOf(m), Columns("unknown"))
+	if err == nil {
+		t.Errorf("update unknown column should fail")
+	}
+}
+
+func TestFillGeneratedPK(t *testing.T) {
+	mapper := NewMapper("test")
+	list := []TestM{{Zone: "a"}, {Zone: "b"}}
+	rows := []reflect.Value{reflect.ValueOf(list).Index(0), reflect.ValueOf(list).Index(1)}
+
+	pk, err := pickUpGeneratedPK(mapper, rows, []string{"zone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk == nil {
+		t.Fatal("pick up generated pk fail")
+	}
+
+	err = fillGeneratedPK(pk, rows, []int64{10, 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list[0].ID != 10 || list[1].ID != 11 {
+		t.Errorf("fill generated pk fail, list = %v", list)
+	}
+
+	pk, _ = pickUpGeneratedPK(mapper, rows, []string{"id", "zone"})
+	if pk != nil {
+		t.Errorf("pk in insert columns should not be generated")
+	}
+
+	pk, _ = pickUpGeneratedPK(mapper, []reflect.Value{reflect.ValueOf(&TestTenantM{}).Elem()}, []string{"name"})
+	if pk != nil {
+		t.Errorf("composite pk should not be generated")
+	}
+}
+
+type TestDefaultM struct {
+	ID        int64 `porm:"pk"`
+	Name      string
+	CreatedAt int64 `porm:"default"`
+}
+
+func (m *TestDefaultM) TableName() string {
+	return "default"
+}
+
+func TestBuilderInsertGroups(t *testing.T) {
+	mapper := NewMapper("test")
+	list := []*TestDefaultM{{Name: "a"}, {ID: 2, Name: "b"}, {Name: "c"}, {Name: "d", CreatedAt: 1}}
+
+	groups, err := BuilderInsertGroups(mapper, nil, reflect.ValueOf(list), psql.Question)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 {
+		t.Fatalf("insert groups size fail, size = %d", len(groups))
+	}
+
+	expects := []struct {
+		query string
+		args  []interface{}
+		rows  []int
+	}{
+		{"INSERT INTO default (name) VALUES (?),(?)", []interface{}{"a", "c"}, []int{0, 2}},
+		{"INSERT INTO default (id,name) VALUES (?,?)", []interface{}{int64(2), "b"}, []int{1}},
+		{"INSERT INTO default (name,created_at) VALUES (?,?)", []interface{}{"d", int64(1)}, []int{3}},
+	}
+	for index, expect := range expects {
+		query, args, err := groups[index].Statement.ToSql()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != expect.query || !reflect.DeepEqual(args, expect.args) || !reflect.DeepEqual(groups[index].Rows, expect.rows) {
+			t.Errorf("insert group fail, query = %s, args = %v, rows = %v", query, args, groups[index].Rows)
+		}
+	}
+
+	err = BuilderInsertList(mapper, psql.NewInsert(psql.Question), reflect.ValueOf(list))
+	if err == nil {
+		t.Errorf("insert list with different columns should fail")
+	}
+
+	err = BuilderInsertList(mapper, psql.NewInsert(psql.Question), reflect.ValueOf([]*TestDefaultM{}))
+	if err == nil {
+		t.Errorf("insert empty list should fail")
+	}
+}
+
+func TestInsertBatchSize(t *testing.T) {
+	mapper := NewMapper("test")
+
+	size, err := insertBatchSize(mapper, MySQL, reflect.TypeOf(&TestM{}), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 100 {
+		t.Errorf("batch size fail, size = %d", size)
+	}
+
+	// TestM 有 7 个非 readonly 的列
+	for _, dialect := range []Dialect{MySQL, PostgreSQL, SQLite} {
+		size, err = insertBatchSize(mapper, dialect, reflect.TypeOf(TestM{}), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != dialect.MaxPlaceholders()/7 {
+			t.Errorf("batch size limited by placeholders fail, dialect = %s, size = %d", dialect.Name(), size)
+		}
+	}
+	if size, _ = insertBatchSize(mapper, SQLite, reflect.TypeOf(TestM{}), 0); size != 4680 {
+		t.Errorf("sqlite batch size fail, size = %d", size)
+	}
+}
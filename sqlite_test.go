@@ -0,0 +1,1095 @@
+package porm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/yongpi/putil/psql"
+)
+
+const (
+	sqliteStorageName  = "sqlite"
+	billingStorageName = "sqlite_billing"
+)
+
+var sqliteDSN, billingDSN string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "porm")
+	if err != nil {
+		panic(err)
+	}
+
+	sqliteDSN = filepath.Join(dir, "porm.db") + "?_busy_timeout=5000"
+	RegisterSimpleStorage(SimpleStorageConfig{
+		DriverName:     "sqlite3",
+		DataSourceName: sqliteDSN,
+		StorageName:    sqliteStorageName,
+	})
+
+	billingDSN = filepath.Join(dir, "billing.db") + "?_busy_timeout=5000&_foreign_keys=1"
+	RegisterSimpleStorage(SimpleStorageConfig{
+		DriverName:     "sqlite3",
+		DataSourceName: billingDSN,
+		StorageName:    billingStorageName,
+	})
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type TestAuthorM struct {
+	ID        int64 `porm:"pk"`
+	Name      string
+	Bio       string
+	MemberID  NullInt64
+	CreatedAt Time
+	UpdatedAt Time `porm:"readonly"`
+}
+
+func (m *TestAuthorM) TableName() string {
+	return "author"
+}
+
+// TestOrderM 表名和列名都是关键字
+type TestOrderM struct {
+	ID    int64 `porm:"pk"`
+	Group string
+}
+
+func (m *TestOrderM) TableName() string {
+	return "order"
+}
+
+type TestInvoiceM struct {
+	ID         int64 `porm:"pk"`
+	CustomerID int64
+}
+
+func (m *TestInvoiceM) TableName() string {
+	return "invoice"
+}
+
+func sqliteORM(t *testing.T) *orm {
+	t.Helper()
+
+	execSQLite(t, sqliteDSN,
+		`DROP TABLE IF EXISTS author`,
+		`CREATE TABLE author (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL DEFAULT '', bio TEXT NOT NULL DEFAULT '',
+			member_id INTEGER, created_at DATETIME, updated_at DATETIME DEFAULT CURRENT_TIMESTAMP)`,
+		`INSERT INTO author (name, bio) VALUES ('a', 'bio a'), ('b', 'bio b')`,
+		`DROP TABLE IF EXISTS "order"`,
+		`CREATE TABLE "order" (id INTEGER PRIMARY KEY AUTOINCREMENT, "group" TEXT NOT NULL DEFAULT '')`,
+	)
+
+	return NORM(sqliteStorageName)
+}
+
+// billingORM invoice 的外键在提交时检查，用来模拟提交失败
+func billingORM(t *testing.T) *orm {
+	t.Helper()
+
+	execSQLite(t, billingDSN,
+		`DROP TABLE IF EXISTS invoice`,
+		`DROP TABLE IF EXISTS customer`,
+		`CREATE TABLE customer (id INTEGER PRIMARY KEY)`,
+		`CREATE TABLE invoice (id INTEGER PRIMARY KEY AUTOINCREMENT,
+			customer_id INTEGER NOT NULL REFERENCES customer(id) DEFERRABLE INITIALLY DEFERRED)`,
+		`INSERT INTO customer (id) VALUES (1)`,
+	)
+
+	return NORM(billingStorageName)
+}
+
+func execSQLite(t *testing.T, dsn string, queries ...string) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	for _, query := range queries {
+		if _, err = db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSQLiteCRUD(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	m := TestAuthorM{Name: "c", Bio: "bio c"}
+	m.MemberID.SetInt64(10)
+	m.CreatedAt.SetTime(time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC))
+	_, err := o.Insert(ctx, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 3 {
+		t.Fatalf("insert generated pk fail, id = %d", m.ID)
+	}
+
+	got, err := Get[*TestAuthorM](ctx, NORM(sqliteStorageName), m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "c" || got.MemberID.Int64 != 10 || !got.CreatedAt.Valid || !got.CreatedAt.Equal(m.CreatedAt.Time) || !got.UpdatedAt.Valid {
+		t.Errorf("get fail, model = %+v", got)
+	}
+
+	list, err := Find[*TestAuthorM](ctx, NORM(sqliteStorageName), psql.Select("*").OrderBy("id").Offset(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "b" {
+		t.Errorf("find with offset fail, size = %d", len(list))
+	}
+
+	got.Name = "cc"
+	got.Bio = "ignored"
+	_, err = NORM(sqliteStorageName).UpdateModel(ctx, got, Columns("name"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = Get[*TestAuthorM](ctx, NORM(sqliteStorageName), m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "cc" || got.Bio != "bio c" {
+		t.Errorf("update columns fail, model = %+v", got)
+	}
+
+	result, err := NORM(sqliteStorageName).DeleteModel(ctx, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := result.RowsAffected(); affected != 2 {
+		t.Errorf("delete model fail, affected = %d", affected)
+	}
+
+	_, err = First[*TestAuthorM](ctx, NORM(sqliteStorageName), psql.Select("*").Where(psql.Eq{"name": "b"}))
+	if err != sql.ErrNoRows {
+		t.Errorf("first after delete should return sql.ErrNoRows, err = %v", err)
+	}
+}
+
+func TestSQLiteDelete(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+	execSQLite(t, sqliteDSN,
+		`DROP TABLE IF EXISTS tenant`,
+		`CREATE TABLE tenant (tenant_id INTEGER, id TEXT, name TEXT NOT NULL DEFAULT '', PRIMARY KEY (tenant_id, id))`,
+		`INSERT INTO tenant (tenant_id, id, name) VALUES (1, 'a', 'a'), (1, 'b', 'b'), (2, 'a', 'c'), (2, 'b', 'd')`,
+		`INSERT INTO author (name) VALUES ('c'), ('d'), ('e')`,
+	)
+
+	var queries []string
+	o = o.WithInterceptor(func(ctx context.Context, op *Operation, next func(ctx context.Context) error) error {
+		queries = append(queries, op.Query)
+		return next(ctx)
+	})
+	deleted := func(want int64) func(result sql.Result, err error) {
+		return func(result sql.Result, err error) {
+			t.Helper()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if affected, _ := result.RowsAffected(); affected != want {
+				t.Errorf("delete fail, affected = %d, want = %d, query = %s", affected, want, queries[len(queries)-1])
+			}
+		}
+	}
+
+	// 单个结构体
+	deleted(1)(o.DeleteModel(ctx, &TestAuthorM{ID: 1}))
+	if query := queries[len(queries)-1]; query != `DELETE FROM "author" WHERE "id" = ?` {
+		t.Errorf("delete model query fail, query = %s", query)
+	}
+
+	// 列表使用 IN
+	deleted(2)(o.DeleteModel(ctx, []*TestAuthorM{{ID: 2}, {ID: 3}}))
+	if query := queries[len(queries)-1]; query != `DELETE FROM "author" WHERE "id" IN (?,?)` {
+		t.Errorf("delete model list query fail, query = %s", query)
+	}
+	deleted(1)(o.DeleteByPK(ctx, 4, &TestAuthorM{}))
+	deleted(1)(o.DeleteByPKs(ctx, []int64{5, 100}, &TestAuthorM{}))
+	if query := queries[len(queries)-1]; query != `DELETE FROM "author" WHERE "id" IN (?,?)` {
+		t.Errorf("delete by pks query fail, query = %s", query)
+	}
+
+	// 联合主键使用 OR
+	deleted(2)(o.DeleteModel(ctx, []TestTenantM{{TenantID: 1, ID: "a"}, {TenantID: 2, ID: "b"}}))
+	want := `DELETE FROM "tenant" WHERE (("tenant_id" = ? AND "id" = ?) OR ("tenant_id" = ? AND "id" = ?))`
+	if query := queries[len(queries)-1]; query != want {
+		t.Errorf("delete composite pk query fail, query = %s", query)
+	}
+	deleted(1)(o.DeleteByPK(ctx, map[string]interface{}{"tenant_id": 1, "id": "b"}, &TestTenantM{}))
+	if query := queries[len(queries)-1]; query != `DELETE FROM "tenant" WHERE ("tenant_id" = ? AND "id" = ?)` {
+		t.Errorf("delete by composite pk query fail, query = %s", query)
+	}
+
+	var rest []TestTenantM
+	if err := o.WithStatement(psql.Select("*")).Select(ctx, &rest); err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 1 || rest[0].TenantID != 2 || rest[0].ID != "a" {
+		t.Errorf("delete composite pk fail, rest = %+v", rest)
+	}
+
+	if _, err := o.DeleteByPK(ctx, 1, &TestTenantM{}); err == nil {
+		t.Errorf("delete composite pk with single value should fail")
+	}
+}
+
+func TestSQLiteQuote(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	orders := []TestOrderM{{Group: "a"}, {Group: "b"}}
+	_, err := o.Insert(ctx, orders)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders[1].Group = "c"
+	_, err = NORM(sqliteStorageName).UpdateModel(ctx, &orders[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list []TestOrderM
+	err = NORM(sqliteStorageName).SelectPKS(ctx, []int64{orders[0].ID, orders[1].ID}, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[1].Group != "c" {
+		t.Errorf("select keyword table fail, list = %+v", list)
+	}
+
+	_, err = NORM(sqliteStorageName).DeleteByPK(ctx, orders[0].ID, &TestOrderM{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAuthorPtrM 通过指针修改的列
+type TestAuthorPtrM struct {
+	ID        int64 `porm:"pk"`
+	Name      *string
+	Bio       string
+	MemberID  *int64
+	CreatedAt Time
+	UpdatedAt Time `porm:"readonly"`
+}
+
+func (m *TestAuthorPtrM) TableName() string {
+	return "author"
+}
+
+func TestSQLiteTracked(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := WithTracking(context.Background())
+
+	var list []TestAuthorM
+	err := o.SelectPKS(ctx, []int64{1, 2}, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := o.UpdateModel(ctx, &list[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := result.RowsAffected(); affected != 0 {
+		t.Errorf("update unchanged model should be noop, affected = %d", affected)
+	}
+
+	list[1].Bio = "changed"
+	result, err = o.UpdateModel(ctx, &list[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		t.Errorf("update changed model fail, affected = %d", affected)
+	}
+
+	// 没有记录的 context 更新所有列
+	result, err = o.UpdateModel(context.Background(), &list[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		t.Errorf("update without tracking should update all columns, affected = %d", affected)
+	}
+
+	// 再次查询到同一个 slice 扩容后，之前的元素依然可以追踪
+	list = list[:1:1]
+	err = o.SelectPKS(ctx, []int64{2}, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := range list {
+		result, err = o.UpdateModel(ctx, &list[index])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if affected, _ := result.RowsAffected(); affected != 0 {
+			t.Errorf("update unchanged model after grow should be noop, index = %d, affected = %d", index, affected)
+		}
+	}
+
+	// 通过指针修改的列
+	var m TestAuthorPtrM
+	err = o.SelectPK(ctx, 1, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*m.Name = "changed"
+	result, err = o.UpdateModel(ctx, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		t.Errorf("update model changed by pointer fail, affected = %d", affected)
+	}
+	member := int64(10)
+	m.MemberID = &member
+	result, err = o.UpdateModel(ctx, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		t.Errorf("update nil pointer column fail, affected = %d", affected)
+	}
+
+	got, err := Get[*TestAuthorM](ctx, o, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "changed" || got.MemberID.Int64 != 10 {
+		t.Errorf("update pointer column fail, model = %+v", got)
+	}
+}
+
+func TestSQLiteTrackedTransaction(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := WithTracking(context.Background())
+	errFail := errors.New("fail")
+
+	var m TestAuthorM
+	if err := o.SelectPK(ctx, 1, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	// 事务回滚后快照不更新，再次更新时依然有变化
+	m.Name = "changed"
+	err := o.Transaction(ctx, func(ctx context.Context, no *orm) error {
+		if _, err := no.UpdateModel(ctx, &m); err != nil {
+			return err
+		}
+		return errFail
+	})
+	if err != errFail {
+		t.Fatalf("tx should fail, err = %v", err)
+	}
+	result, err := o.UpdateModel(ctx, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		t.Errorf("update after rollback should not be noop, affected = %d", affected)
+	}
+
+	// 重试的事务中再次更新
+	m.Name = "retry"
+	var attempts int
+	policy := &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, Retryable: func(err error) bool {
+		return err == errFail
+	}}
+	err = o.Transaction(ctx, func(ctx context.Context, no *orm) error {
+		attempts++
+		if _, err := no.UpdateModel(ctx, &m); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return errFail
+		}
+		return nil
+	}, TxOptions{Retry: policy})
+	if err != nil || attempts != 2 {
+		t.Fatalf("retry tx fail, attempts = %d, err = %v", attempts, err)
+	}
+	got, err := Get[*TestAuthorM](context.Background(), o, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "retry" {
+		t.Errorf("retried update should be written, got = %+v", got)
+	}
+
+	// 提交后更新快照
+	result, err = o.UpdateModel(ctx, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := result.RowsAffected(); affected != 0 {
+		t.Errorf("update after commit should be noop, affected = %d", affected)
+	}
+}
+
+func TestSQLiteUpsert(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	_, err := o.Upsert(ctx, &TestAuthorM{ID: 1, Name: "up", Bio: "not updated"}, nil, []string{"name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := NORM(sqliteStorageName).InsertIgnore(ctx, []*TestAuthorM{{ID: 1, Name: "ignored"}, {ID: 5, Name: "e"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		t.Errorf("insert ignore fail, affected = %d", affected)
+	}
+
+	got, err := Get[*TestAuthorM](ctx, NORM(sqliteStorageName), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "up" || got.Bio != "bio a" {
+		t.Errorf("upsert fail, model = %+v", got)
+	}
+}
+
+func TestSQLiteBatchInsert(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	list := []TestAuthorM{{Name: "c"}, {ID: 10, Name: "d"}, {Name: "e"}}
+	result, err := o.Insert(ctx, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := result.RowsAffected(); affected != 3 {
+		t.Errorf("insert mixed pk fail, affected = %d", affected)
+	}
+	if list[0].ID != 3 || list[1].ID != 10 || list[2].ID != 4 {
+		t.Errorf("insert mixed pk generated pk fail, list = %+v", list)
+	}
+
+	batch := make([]*TestAuthorM, 25)
+	for index := range batch {
+		batch[index] = &TestAuthorM{Name: "batch"}
+	}
+	total, err := NORM(sqliteStorageName).BatchInsert(ctx, batch, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 25 || batch[24].ID != 35 {
+		t.Errorf("batch insert fail, total = %d, last id = %d", total, batch[24].ID)
+	}
+
+	// 不指定 batchSize 时按 sqlite 的占位符数量限制分批
+	orders := make([]TestOrderM, 40000)
+	for index := range orders {
+		orders[index].Group = "batch"
+	}
+	total, err = NORM(sqliteStorageName).BatchInsert(ctx, orders, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 40000 || orders[39999].ID != 40000 {
+		t.Errorf("batch insert limited by placeholders fail, total = %d, last id = %d", total, orders[39999].ID)
+	}
+
+	// 失败时所有批次回滚
+	_, err = NORM(sqliteStorageName).BatchInsert(ctx, []TestAuthorM{{ID: 100}, {ID: 100}}, 1)
+	if err == nil {
+		t.Fatal("batch insert duplicate pk should fail")
+	}
+	_, err = Get[*TestAuthorM](ctx, NORM(sqliteStorageName), 100)
+	if err != sql.ErrNoRows {
+		t.Errorf("batch insert should rollback, err = %v", err)
+	}
+}
+
+func TestSQLiteNestedTransaction(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+	errInner := errors.New("inner fail")
+
+	err := o.Transaction(ctx, func(ctx context.Context, no *orm) error {
+		_, err := no.Insert(ctx, &TestAuthorM{ID: 10, Name: "outer"})
+		if err != nil {
+			return err
+		}
+
+		// 内层回滚到 savepoint，不影响外层
+		err = NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+			_, err := NORM(sqliteStorageName).Insert(ctx, &TestAuthorM{ID: 11, Name: "inner"})
+			if err != nil {
+				return err
+			}
+			return errInner
+		})
+		if err != errInner {
+			t.Errorf("inner transaction should return inner error, err = %v", err)
+		}
+
+		// 内层提交后随外层一起提交
+		return NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+			_, err := no.Insert(ctx, &TestAuthorM{ID: 12, Name: "released"})
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, exist := range map[int64]bool{10: true, 11: false, 12: true} {
+		_, err = Get[*TestAuthorM](ctx, NORM(sqliteStorageName), id)
+		if exist != (err == nil) {
+			t.Errorf("nested transaction fail, id = %d, err = %v", id, err)
+		}
+	}
+
+	// 外层回滚时已经提交的内层也回滚
+	err = NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+		err := no.Transaction(ctx, func(ctx context.Context, no *orm) error {
+			_, err := no.Insert(ctx, &TestAuthorM{ID: 13, Name: "inner"})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return errInner
+	})
+	if err != errInner {
+		t.Fatalf("outer transaction should return error, err = %v", err)
+	}
+	_, err = Get[*TestAuthorM](ctx, NORM(sqliteStorageName), 13)
+	if err != sql.ErrNoRows {
+		t.Errorf("outer rollback should rollback inner, err = %v", err)
+	}
+}
+
+func TestSQLiteFlattenTransaction(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+
+	err := o.Transaction(ctx, func(ctx context.Context, no *orm) error {
+		err := NORM(sqliteStorageName).Flatten().Transaction(ctx, func(ctx context.Context, no *orm) error {
+			_, err := no.Insert(ctx, &TestAuthorM{ID: 10, Name: "inner"})
+			if err != nil {
+				return err
+			}
+			return errors.New("inner fail")
+		})
+		if err == nil {
+			t.Errorf("inner transaction should return error")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 平铺的内层回滚不做处理，随外层提交
+	_, err = Get[*TestAuthorM](ctx, NORM(sqliteStorageName), 10)
+	if err != nil {
+		t.Errorf("flatten transaction should commit with outer, err = %v", err)
+	}
+}
+
+func TestSQLitePropagation(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+	errOuter := errors.New("outer fail")
+
+	exist := func(id int64) bool {
+		_, err := Get[*TestAuthorM](ctx, NORM(sqliteStorageName), id)
+		return err == nil
+	}
+
+	// 独立的新事务不受外层回滚影响
+	err := o.Transaction(ctx, func(ctx context.Context, no *orm) error {
+		err := no.Transaction(ctx, func(ctx context.Context, no *orm) error {
+			_, err := no.Insert(ctx, &TestAuthorM{ID: 10, Name: "requires new"})
+			return err
+		}, TxOptions{Propagation: PropagationRequiresNew})
+		if err != nil {
+			return err
+		}
+
+		_, err = no.Insert(ctx, &TestAuthorM{ID: 11, Name: "outer"})
+		if err != nil {
+			return err
+		}
+		return errOuter
+	})
+	if err != errOuter {
+		t.Fatalf("outer transaction should return error, err = %v", err)
+	}
+	if !exist(10) || exist(11) {
+		t.Errorf("requires new fail")
+	}
+
+	// 不使用事务，语句直接提交
+	err = NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+		err := NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+			_, err := no.Insert(ctx, &TestAuthorM{ID: 12, Name: "not supported"})
+			return err
+		}, TxOptions{Propagation: PropagationNotSupported})
+		if err != nil {
+			return err
+		}
+		return errOuter
+	})
+	if err != errOuter {
+		t.Fatalf("outer transaction should return error, err = %v", err)
+	}
+
+	err = NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+		_, err := no.Insert(ctx, &TestAuthorM{ID: 13, Name: "supports"})
+		if err != nil {
+			return err
+		}
+		return errOuter
+	}, TxOptions{Propagation: PropagationSupports})
+	if err != errOuter {
+		t.Fatalf("supports transaction should return error, err = %v", err)
+	}
+	if !exist(12) || !exist(13) {
+		t.Errorf("not supported or supports without tx fail")
+	}
+
+	// 加入外层事务，随外层回滚
+	err = NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+		err := NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+			_, err := no.Insert(ctx, &TestAuthorM{ID: 14, Name: "mandatory"})
+			return err
+		}, TxOptions{Propagation: PropagationMandatory})
+		if err != nil {
+			return err
+		}
+
+		err = no.Transaction(ctx, func(ctx context.Context, no *orm) error {
+			return nil
+		}, TxOptions{Propagation: PropagationNever})
+		if err == nil {
+			t.Errorf("never in tx should fail")
+		}
+		return errOuter
+	})
+	if err != errOuter {
+		t.Fatalf("outer transaction should return error, err = %v", err)
+	}
+	if exist(14) {
+		t.Errorf("mandatory should join outer tx")
+	}
+
+	err = NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+		return nil
+	}, TxOptions{Propagation: PropagationMandatory})
+	if err == nil {
+		t.Errorf("mandatory without tx should fail")
+	}
+
+	// 平铺模式下 Nested 仍然使用 savepoint
+	err = NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+		err := NORM(sqliteStorageName).Flatten().Transaction(ctx, func(ctx context.Context, no *orm) error {
+			_, err := no.Insert(ctx, &TestAuthorM{ID: 15, Name: "nested"})
+			if err != nil {
+				return err
+			}
+			return errOuter
+		}, TxOptions{Propagation: PropagationNested})
+		if err != errOuter {
+			t.Errorf("nested transaction should return error, err = %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exist(15) {
+		t.Errorf("nested should rollback to savepoint")
+	}
+}
+
+func TestSQLiteMultiTransaction(t *testing.T) {
+	authors, invoices := sqliteORM(t), billingORM(t)
+	ctx := context.Background()
+	errFail := errors.New("fail")
+
+	exist := func(storageName string, id int64) bool {
+		var count int64
+		table := map[string]string{sqliteStorageName: "author", billingStorageName: "invoice"}[storageName]
+		err := NORM(storageName).DB().QueryRowContext(ctx, "SELECT COUNT(1) FROM "+table+" WHERE id = ?", id).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count == 1
+	}
+
+	err := MultiTransaction(ctx, func(ctx context.Context, orms []*orm) error {
+		if StorageTxORMFromContext(ctx, sqliteStorageName) != orms[0] || StorageTxORMFromContext(ctx, billingStorageName) != orms[1] {
+			t.Errorf("context should carry tx of each storage")
+		}
+
+		// 不同 storage 的调用各自加入对应的事务
+		_, err := NORM(sqliteStorageName).Insert(ctx, &TestAuthorM{ID: 10, Name: "multi"})
+		if err != nil {
+			return err
+		}
+		return NORM(billingStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+			_, err := no.Insert(ctx, &TestInvoiceM{ID: 10, CustomerID: 1})
+			return err
+		})
+	}, authors, invoices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exist(sqliteStorageName, 10) || !exist(billingStorageName, 10) {
+		t.Errorf("multi transaction commit fail")
+	}
+
+	err = MultiTransaction(ctx, func(ctx context.Context, orms []*orm) error {
+		_, err := NORM(sqliteStorageName).Insert(ctx, &TestAuthorM{ID: 11, Name: "multi"})
+		if err != nil {
+			return err
+		}
+		_, err = NORM(billingStorageName).Insert(ctx, &TestInvoiceM{ID: 11, CustomerID: 1})
+		if err != nil {
+			return err
+		}
+		return errFail
+	}, NORM(sqliteStorageName), NORM(billingStorageName))
+	if err != errFail {
+		t.Fatalf("multi transaction should return error, err = %v", err)
+	}
+	if exist(sqliteStorageName, 11) || exist(billingStorageName, 11) {
+		t.Errorf("multi transaction rollback fail")
+	}
+
+	// billing 提交时外键检查失败，sqlite 已经提交
+	err = MultiTransaction(ctx, func(ctx context.Context, orms []*orm) error {
+		_, err := NORM(sqliteStorageName).Insert(ctx, &TestAuthorM{ID: 12, Name: "multi"})
+		if err != nil {
+			return err
+		}
+		_, err = NORM(billingStorageName).Insert(ctx, &TestInvoiceM{ID: 12, CustomerID: 2})
+		return err
+	}, NORM(sqliteStorageName), NORM(billingStorageName))
+
+	var me *MultiCommitError
+	if !errors.As(err, &me) {
+		t.Fatalf("partial commit should return MultiCommitError, err = %v", err)
+	}
+	if !reflect.DeepEqual(me.Committed, []string{sqliteStorageName}) || me.Failed != billingStorageName {
+		t.Errorf("multi commit error fail, err = %v", me)
+	}
+	if !exist(sqliteStorageName, 12) || exist(billingStorageName, 12) {
+		t.Errorf("partial commit fail")
+	}
+
+	err = MultiTransaction(ctx, func(ctx context.Context, orms []*orm) error {
+		return nil
+	}, NORM(sqliteStorageName), NORM(sqliteStorageName))
+	if err == nil {
+		t.Errorf("duplicate storage should fail")
+	}
+}
+
+func TestSQLiteTransactionRetry(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+	errConflict := errors.New("conflict")
+
+	var retries []int
+	id := InjectHook(func(ctx context.Context, o *orm) {
+		if info := TxRetryFromContext(ctx); info != nil && info.Err == errConflict {
+			retries = append(retries, info.Attempt)
+		}
+	}, BeforeTxRetry)
+	defer RemoveHook(id)
+
+	policy := &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, Retryable: func(err error) bool {
+		return err == errConflict
+	}}
+
+	var attempts int
+	err := o.Transaction(ctx, func(ctx context.Context, no *orm) error {
+		attempts++
+		_, err := no.Insert(ctx, &TestAuthorM{ID: 10, Name: "retry"})
+		if err != nil {
+			return err
+		}
+		if attempts < 3 {
+			return errConflict
+		}
+		return nil
+	}, TxOptions{Retry: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 || !reflect.DeepEqual(retries, []int{1, 2}) {
+		t.Errorf("retry fail, attempts = %d, retries = %v", attempts, retries)
+	}
+
+	// 超过最大次数返回最后一次的错误
+	attempts = 0
+	err = NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+		attempts++
+		return errConflict
+	}, TxOptions{Retry: policy})
+	if err != errConflict || attempts != 3 {
+		t.Errorf("retry max attempts fail, attempts = %d, err = %v", attempts, err)
+	}
+
+	// 加入外层事务时不重试
+	attempts = 0
+	err = NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+		return no.Transaction(ctx, func(ctx context.Context, no *orm) error {
+			attempts++
+			return errConflict
+		}, TxOptions{Retry: policy})
+	})
+	if err != errConflict || attempts != 1 {
+		t.Errorf("inner transaction should not retry, attempts = %d, err = %v", attempts, err)
+	}
+
+	// hook 调用 Abort 时不再重试
+	errAbort := errors.New("abort")
+	attempts = 0
+	err = NORM(sqliteStorageName).WithHook(func(ctx context.Context, o *orm) {
+		o.Abort(errAbort)
+	}, BeforeTxRetry).Transaction(ctx, func(ctx context.Context, no *orm) error {
+		attempts++
+		return errConflict
+	}, TxOptions{Retry: policy})
+	if err != errAbort || attempts != 1 {
+		t.Errorf("abort retry fail, attempts = %d, err = %v", attempts, err)
+	}
+}
+
+func TestSQLiteHookAbort(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+	errAbort := errors.New("abort")
+
+	var rollbacks int
+	no := o.WithHook(func(ctx context.Context, o *orm) {
+		o.Abort(errAbort)
+	}, BeforeInsert).WithHook(func(ctx context.Context, o *orm) {
+		rollbacks++
+	}, AfterRollback)
+
+	_, err := no.Insert(ctx, &TestAuthorM{ID: 10, Name: "abort"})
+	if err != errAbort {
+		t.Errorf("abort insert should return errAbort, err = %v", err)
+	}
+	// 中止时回滚 TxHook 为语句开启的事务，不占用连接
+	if rollbacks != 1 || o.DB().Stats().InUse != 0 {
+		t.Errorf("abort insert should rollback tx, rollbacks = %d, in use = %d", rollbacks, o.DB().Stats().InUse)
+	}
+
+	var list []*TestAuthorM
+	if err = o.WithStatement(psql.Select("*").Where(psql.Eq{"id": 10})).Select(ctx, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("abort insert should not insert, list = %+v", list)
+	}
+
+	// session 的 After hook 先执行，语句失败时依然结束事务
+	no = o.WithHook(func(ctx context.Context, o *orm) {}, AfterInsert)
+	if _, err = no.Insert(ctx, &TestAuthorM{ID: 1, Name: "duplicate"}); err == nil {
+		t.Fatal("insert duplicate pk should fail")
+	}
+	if in := o.DB().Stats().InUse; in != 0 {
+		t.Errorf("failed insert should rollback tx, in use = %d", in)
+	}
+	if _, err = o.Insert(ctx, &TestAuthorM{ID: 11, Name: "after fail"}); err != nil {
+		t.Errorf("insert after failed insert fail, err = %v", err)
+	}
+
+	// After hook 中止时回滚写入
+	no = o.WithHook(func(ctx context.Context, o *orm) {
+		o.Abort(errAbort)
+	}, AfterInsert)
+	if _, err = no.Insert(ctx, &TestAuthorM{ID: 12, Name: "abort"}); err != errAbort {
+		t.Errorf("abort after insert should return errAbort, err = %v", err)
+	}
+	if in := o.DB().Stats().InUse; in != 0 {
+		t.Errorf("abort after insert should rollback tx, in use = %d", in)
+	}
+	if _, err = Get[*TestAuthorM](ctx, o, 12); err != sql.ErrNoRows {
+		t.Errorf("abort after insert should rollback insert, err = %v", err)
+	}
+}
+
+func TestSQLiteTxCallback(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := context.Background()
+	errFail := errors.New("fail")
+
+	var events []string
+	record := func(event string) func(ctx context.Context) {
+		return func(ctx context.Context) {
+			events = append(events, event)
+		}
+	}
+
+	err := o.Transaction(ctx, func(ctx context.Context, no *orm) error {
+		_ = no.OnCommit(ctx, record("outer commit"))
+		_ = no.OnRollback(ctx, record("outer rollback"))
+
+		// savepoint 回滚后丢弃 OnCommit，OnRollback 在最外层结束后执行
+		_ = NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+			_ = NORM(sqliteStorageName).OnCommit(ctx, record("inner commit"))
+			_ = NORM(sqliteStorageName).OnRollback(ctx, record("inner rollback"))
+			return errFail
+		})
+
+		_ = no.Transaction(ctx, func(ctx context.Context, no *orm) error {
+			return no.OnCommit(ctx, record("released commit"))
+		})
+
+		if len(events) != 0 {
+			t.Errorf("callbacks should run after outermost commit, events = %v", events)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(events, []string{"outer commit", "released commit", "inner rollback"}) {
+		t.Errorf("commit callbacks fail, events = %v", events)
+	}
+
+	events = nil
+	err = NORM(sqliteStorageName).Transaction(ctx, func(ctx context.Context, no *orm) error {
+		_ = no.OnCommit(ctx, record("commit"))
+		_ = no.OnRollback(ctx, func(ctx context.Context) {
+			panic("callback panic")
+		})
+		_ = no.OnRollback(ctx, record("rollback"))
+		return errFail
+	})
+	if err != errFail || !reflect.DeepEqual(events, []string{"rollback"}) {
+		t.Errorf("rollback callbacks fail, err = %v, events = %v", err, events)
+	}
+
+	// 提交失败时执行 OnRollback
+	events = nil
+	err = billingORM(t).Transaction(ctx, func(ctx context.Context, no *orm) error {
+		_ = no.OnCommit(ctx, record("commit"))
+		_ = no.OnRollback(ctx, record("rollback"))
+		_, err := no.Insert(ctx, &TestInvoiceM{CustomerID: 2})
+		return err
+	})
+	if err == nil || !reflect.DeepEqual(events, []string{"rollback"}) {
+		t.Errorf("commit fail callbacks fail, err = %v, events = %v", err, events)
+	}
+
+	// 不在事务中时 OnCommit 直接执行
+	events = nil
+	_ = NORM(sqliteStorageName).OnCommit(ctx, record("no tx"))
+	_ = NORM(sqliteStorageName).OnRollback(ctx, record("no tx rollback"))
+	if !reflect.DeepEqual(events, []string{"no tx"}) {
+		t.Errorf("callbacks without tx fail, events = %v", events)
+	}
+}
+
+func TestSQLiteConcurrent(t *testing.T) {
+	o := sqliteORM(t)
+	ctx := WithTracking(context.Background())
+	retry := TxOptions{Retry: &RetryPolicy{MaxAttempts: 5, Backoff: time.Millisecond}}
+
+	// 构建方法返回副本，不修改原来的 orm
+	if o.ForceMaster(); o.forceMaster {
+		t.Errorf("ForceMaster should not change root orm")
+	}
+
+	// 失败的调用不影响后面的调用
+	_, err := o.SelectX(ctx, "SELECT * FROM not_exist")
+	if err == nil {
+		t.Fatal("select not exist table should fail")
+	}
+	_, err = Get[*TestAuthorM](ctx, o, 1)
+	if err != nil {
+		t.Fatalf("error should not leak to next call, err = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			m := &TestAuthorM{Name: fmt.Sprintf("concurrent %d", i)}
+			_, err := o.Insert(ctx, m)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			var got TestAuthorM
+			err = o.SelectPK(ctx, m.ID, &got)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			got.Bio = "updated"
+			_, err = o.UpdateModel(ctx, &got)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			errs <- o.Transaction(ctx, func(ctx context.Context, no *orm) error {
+				_, err := no.Insert(ctx, &TestAuthorM{Name: fmt.Sprintf("tx %d", i)})
+				if err != nil {
+					return err
+				}
+				_, err = NORM(sqliteStorageName).DeleteModel(ctx, &got)
+				return err
+			}, retry)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	var count int64
+	err = o.WithStatement(psql.Select("*")).SelectWithCount(ctx, &[]TestAuthorM{}, &count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 22 {
+		t.Errorf("concurrent write fail, count = %d", count)
+	}
+}
@@ -1,8 +1,10 @@
 package porm
 
 import (
+	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/yongpi/putil/psql"
 )
@@ -12,19 +14,36 @@ type Storage interface {
 	GetName() string
 	SqlBuilder() psql.SqlBuilder
 	GetMapper() *mapper
+	Dialect() Dialect
+}
+
+// trackedStorage 需要记录每次执行情况的 Storage，track 返回本次使用的 db，执行结束后调用 done
+type trackedStorage interface {
+	track(orm *orm) (db *DB, done func(err error))
 }
 
 var (
 	defaultStorage Storage
 	ormOnce        sync.Once
+	depositoryLock sync.RWMutex
 	depository     = make(map[string]Storage)
 )
 
+func lookupStorage(storageName string) Storage {
+	depositoryLock.RLock()
+	defer depositoryLock.RUnlock()
+
+	return depository[storageName]
+}
+
 func RegisterStorage(storage Storage) {
 	ormOnce.Do(func() {
 		defaultStorage = storage
 	})
 
+	depositoryLock.Lock()
+	defer depositoryLock.Unlock()
+
 	_, ok := depository[storage.GetName()]
 	if !ok {
 		depository[storage.GetName()] = storage
@@ -37,7 +56,7 @@ func RegisterSimpleStorage(config SimpleStorageConfig) {
 		panic(err)
 	}
 	sqlBuilder := psql.NewSqlBuilder(config.HolderType)
-	storage := &SimpleStorage{db: db, sqlBuilder: &sqlBuilder, Name: config.StorageName}
+	storage := &SimpleStorage{db: db, sqlBuilder: &sqlBuilder, Name: config.StorageName, dialect: config.dialect()}
 	RegisterStorage(storage)
 }
 
@@ -46,12 +65,33 @@ type SimpleStorageConfig struct {
 	DataSourceName string
 	StorageName    string
 	HolderType     psql.PlaceHolderType
+	// Dialect 为空时根据 DriverName 选择
+	Dialect Dialect
+	// Weight 作为从库时的权重，加权轮询时使用，默认为 1
+	Weight int
+}
+
+func (c SimpleStorageConfig) dialect() Dialect {
+	if c.Dialect != nil {
+		return c.Dialect
+	}
+	return LookupDialect(c.DriverName)
 }
 
 type SimpleStorage struct {
 	db         *DB
 	sqlBuilder *psql.SqlBuilder
 	Name       string
+	dialect    Dialect
+	hooks      *HookRegistry
+	hooksOnce  sync.Once
+}
+
+func (s *SimpleStorage) Hooks() *HookRegistry {
+	s.hooksOnce.Do(func() {
+		s.hooks = NewHookRegistry()
+	})
+	return s.hooks
 }
 
 func (s *SimpleStorage) GetDB(orm *orm) *DB {
@@ -70,11 +110,30 @@ func (s *SimpleStorage) GetMapper() *mapper {
 	return s.db.Mapper()
 }
 
+func (s *SimpleStorage) Dialect() Dialect {
+	return s.dialect
+}
+
 type MasterSlaveStorage struct {
-	master     *SimpleStorage
-	slaves     []*SimpleStorage
-	count      int64
-	sqlBuilder psql.SqlBuilder
+	master       *SimpleStorage
+	slaves       []*replica
+	count        int64
+	sqlBuilder   psql.SqlBuilder
+	dialect      Dialect
+	hooks        *HookRegistry
+	hooksOnce    sync.Once
+	balancer     Balancer
+	stickyWindow time.Duration
+	healthConfig HealthCheckConfig
+	stop         chan struct{}
+	stopOnce     sync.Once
+}
+
+func (s *MasterSlaveStorage) Hooks() *HookRegistry {
+	s.hooksOnce.Do(func() {
+		s.hooks = NewHookRegistry()
+	})
+	return s.hooks
 }
 
 func (s *MasterSlaveStorage) GetDB(orm *orm) *DB {
@@ -93,27 +152,63 @@ func (s *MasterSlaveStorage) GetMapper() *mapper {
 	return s.master.GetMapper()
 }
 
+func (s *MasterSlaveStorage) Dialect() Dialect {
+	return s.dialect
+}
+
+// RoundRobinSlave 轮询可用的从库，没有可用的从库时返回主库
 func (s *MasterSlaveStorage) RoundRobinSlave() Storage {
-	index := s.count % int64(len(s.slaves))
-	slave := s.slaves[index]
-	atomic.AddInt64(&s.count, 1)
-	return slave
+	healthy := make([]*replica, 0, len(s.slaves))
+	for _, slave := range s.slaves {
+		if slave.available() {
+			healthy = append(healthy, slave)
+		}
+	}
+	if len(healthy) == 0 {
+		return s.master
+	}
+
+	index := (atomic.AddInt64(&s.count, 1) - 1) % int64(len(healthy))
+	return healthy[index].SimpleStorage
+}
+
+func (s *MasterSlaveStorage) useMaster(orm *orm) bool {
+	return orm.forceMaster || orm.sqlAction != Select || len(s.slaves) == 0
 }
 
 func (s *MasterSlaveStorage) pick(orm *orm) Storage {
-	if orm.forceMaster || orm.sqlAction != Select || len(s.slaves) == 0 {
+	if s.useMaster(orm) {
 		return s.master
 	}
-	return s.RoundRobinSlave()
+	if r := s.pickReplica(); r != nil {
+		return r.SimpleStorage
+	}
+	return s.master
 }
 
 type MasterSlaveStorageConfig struct {
 	StorageName string
 	HolderType  psql.PlaceHolderType
-	DBConfigs   []*SimpleStorageConfig
+	// DBConfigs 第一个为主库，其余为从库
+	DBConfigs []*SimpleStorageConfig
+	// HealthCheck 不为空时在后台定时检查从库，剔除不健康的从库
+	HealthCheck *HealthCheckConfig
+	// Balancer 选择从库的策略，默认为加权轮询
+	Balancer Balancer
+	// StickyWindow 使用 WithReadYourWrites 的 context 写之后读主库的时间，为 0 时 context 中写过就一直读主库
+	StickyWindow time.Duration
 }
 
 func RegisterMasterSlaveStorage(config MasterSlaveStorageConfig) {
+	ms := newMasterSlaveStorage(config)
+	if config.HealthCheck != nil {
+		ms.startHealthCheck()
+	}
+
+	RegisterStorage(ms)
+}
+
+func newMasterSlaveStorage(config MasterSlaveStorageConfig) *MasterSlaveStorage {
 	ms := &MasterSlaveStorage{}
 	storageName := config.StorageName
 	for index, cf := range config.DBConfigs {
@@ -121,14 +216,33 @@ func RegisterMasterSlaveStorage(config MasterSlaveStorageConfig) {
 		if err != nil {
 			panic(err)
 		}
-		ss := &SimpleStorage{db: db, Name: storageName}
+		ss := &SimpleStorage{db: db, Name: storageName, dialect: cf.dialect()}
 		if index == 0 {
 			ms.master = ss
+			ms.dialect = ss.dialect
+			continue
 		}
 
-		ms.slaves = append(ms.slaves, ss)
+		ms.slaves = append(ms.slaves, newReplica(ss, index, cf.Weight))
 	}
 	ms.sqlBuilder = psql.NewSqlBuilder(config.HolderType)
 
-	RegisterStorage(ms)
+	ms.stickyWindow = config.StickyWindow
+	ms.balancer = config.Balancer
+	if ms.balancer == nil {
+		ms.balancer = NewWeightedRoundRobinBalancer()
+	}
+
+	var hc HealthCheckConfig
+	if config.HealthCheck != nil {
+		hc = *config.HealthCheck
+	}
+	ms.healthConfig = hc.withDefault()
+	if ms.healthConfig.MaxLag > 0 && ms.healthConfig.LagProbe == nil {
+		ms.healthConfig.LagProbe = lookupLagProbe(ms.dialect)
+		if ms.healthConfig.LagProbe == nil {
+			panic(fmt.Errorf("[porm:RegisterMasterSlaveStorage]: lag probe not found, storage = %s", storageName))
+		}
+	}
+	return ms
 }
@@ -0,0 +1,291 @@
+package porm
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yongpi/putil/psql"
+)
+
+// masterSlaveConfig 主库和 replicas 个从库都使用 sqliteDSN
+func masterSlaveConfig(storageName string, replicas int) MasterSlaveStorageConfig {
+	config := MasterSlaveStorageConfig{StorageName: storageName}
+	for i := 0; i <= replicas; i++ {
+		config.DBConfigs = append(config.DBConfigs, &SimpleStorageConfig{DriverName: "sqlite3", DataSourceName: sqliteDSN})
+	}
+	return config
+}
+
+// pickDBs 返回 count 次读请求使用的 db
+func pickDBs(s *MasterSlaveStorage, count int) map[*DB]int {
+	dbs := make(map[*DB]int)
+	for i := 0; i < count; i++ {
+		dbs[s.GetDB(&orm{sqlAction: Select})]++
+	}
+	return dbs
+}
+
+func TestMasterSlaveHealth(t *testing.T) {
+	ctx := context.Background()
+
+	var down sync.Map
+	config := masterSlaveConfig("sqlite_health", 2)
+	config.HealthCheck = &HealthCheckConfig{
+		FailThreshold:    2,
+		RecoverThreshold: 2,
+		Check: func(ctx context.Context, db *DB) error {
+			if _, ok := down.Load(db); ok {
+				return errors.New("replica down")
+			}
+			return db.PingContext(ctx)
+		},
+	}
+	s := newMasterSlaveStorage(config)
+	master, r1, r2 := s.master.db, s.slaves[0].db, s.slaves[1].db
+
+	// 主库不参与读
+	dbs := pickDBs(s, 4)
+	if len(dbs) != 2 || dbs[r1] != 2 || dbs[r2] != 2 {
+		t.Fatalf("read should round robin replicas, dbs = %v", dbs)
+	}
+	if s.GetDB(&orm{sqlAction: Insert}) != master || s.GetDB(&orm{sqlAction: Select, forceMaster: true}) != master {
+		t.Fatalf("write and force master should use master")
+	}
+
+	// 连续失败达到阈值后剔除
+	down.Store(r1, true)
+	s.CheckHealth(ctx)
+	if !s.Health()[0].Healthy {
+		t.Fatalf("replica should not be ejected before threshold, health = %+v", s.Health())
+	}
+	s.CheckHealth(ctx)
+	status := s.Health()[0]
+	if status.Healthy || status.Failures != 2 || status.LastError == nil || status.Index != 1 {
+		t.Fatalf("replica should be ejected, status = %+v", status)
+	}
+	if dbs = pickDBs(s, 4); len(dbs) != 1 || dbs[r2] != 4 {
+		t.Fatalf("read should skip ejected replica, dbs = %v", dbs)
+	}
+
+	// 所有从库都不健康时读主库
+	down.Store(r2, true)
+	s.CheckHealth(ctx)
+	s.CheckHealth(ctx)
+	if dbs = pickDBs(s, 2); len(dbs) != 1 || dbs[master] != 2 {
+		t.Fatalf("read should fall back to master, dbs = %v", dbs)
+	}
+
+	// 连续成功达到阈值后恢复
+	down.Delete(r1)
+	down.Delete(r2)
+	s.CheckHealth(ctx)
+	if dbs = pickDBs(s, 2); dbs[master] != 2 {
+		t.Fatalf("replica should not recover before threshold, dbs = %v", dbs)
+	}
+	s.CheckHealth(ctx)
+	if dbs = pickDBs(s, 4); dbs[r1] != 2 || dbs[r2] != 2 {
+		t.Fatalf("replica should recover, dbs = %v", dbs)
+	}
+	for _, status := range s.Health() {
+		if !status.Healthy || status.Successes != 2 || status.LastError != nil {
+			t.Errorf("replica status fail, status = %+v", status)
+		}
+	}
+}
+
+func TestMasterSlaveHealthCheck(t *testing.T) {
+	const storageName = "sqlite_health_check"
+
+	config := masterSlaveConfig(storageName, 1)
+	config.HealthCheck = &HealthCheckConfig{
+		Interval: 10 * time.Millisecond,
+		Check: func(ctx context.Context, db *DB) error {
+			return errors.New("replica down")
+		},
+	}
+	RegisterMasterSlaveStorage(config)
+	defer lookupStorage(storageName).(*MasterSlaveStorage).StopHealthCheck()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		health, err := StorageHealth(storageName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !health[0].Healthy {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background health check not run, health = %+v", health)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := StorageHealth(sqliteStorageName); err == nil {
+		t.Errorf("simple storage has no health")
+	}
+}
+
+// laggingReplicaConfig 从库使用单独的空库，模拟还没有同步的从库
+func laggingReplicaConfig(t *testing.T, storageName string) MasterSlaveStorageConfig {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), "replica.db")
+	execSQLite(t, dsn, `CREATE TABLE author (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL DEFAULT '', bio TEXT NOT NULL DEFAULT '',
+			member_id INTEGER, created_at DATETIME, updated_at DATETIME DEFAULT CURRENT_TIMESTAMP)`)
+
+	config := masterSlaveConfig(storageName, 1)
+	config.DBConfigs[1].DataSourceName = dsn
+	return config
+}
+
+func TestReadYourWrites(t *testing.T) {
+	sqliteORM(t)
+	o := &orm{storage: newMasterSlaveStorage(laggingReplicaConfig(t, "sqlite_read_your_writes"))}
+	ctx := WithReadYourWrites(context.Background())
+
+	count := func(ctx context.Context) int {
+		list, err := Find[*TestAuthorM](ctx, o, psql.Select("*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(list)
+	}
+
+	if n := count(ctx); n != 0 {
+		t.Fatalf("read before write should use replica, count = %d", n)
+	}
+	if _, err := o.Insert(ctx, &TestAuthorM{Name: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(ctx); n != 3 {
+		t.Errorf("read after write should use master, count = %d", n)
+	}
+	if n := count(WithReadYourWrites(ctx)); n != 3 {
+		t.Errorf("nested context should share writes, count = %d", n)
+	}
+	if n := count(context.Background()); n != 0 {
+		t.Errorf("read without marker should use replica, count = %d", n)
+	}
+
+	// 写失败时不读主库
+	other := WithReadYourWrites(context.Background())
+	if _, err := o.InsertX(other, "INSERT INTO not_exist (id) VALUES (1)"); err == nil {
+		t.Fatal("insert into not exist table should fail")
+	}
+	if n := count(other); n != 0 {
+		t.Errorf("failed write should not stick to master, count = %d", n)
+	}
+}
+
+func TestReadYourWritesWindow(t *testing.T) {
+	sqliteORM(t)
+	config := laggingReplicaConfig(t, "sqlite_sticky_window")
+	config.StickyWindow = 200 * time.Millisecond
+	o := &orm{storage: newMasterSlaveStorage(config)}
+	ctx := WithReadYourWrites(context.Background())
+
+	if _, err := o.Insert(ctx, &TestAuthorM{Name: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := Find[*TestAuthorM](ctx, o, psql.Select("*")); len(list) != 3 {
+		t.Errorf("read in sticky window should use master, list = %+v", list)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if list, _ := Find[*TestAuthorM](ctx, o, psql.Select("*")); len(list) != 0 {
+		t.Errorf("read after sticky window should use replica, list = %+v", list)
+	}
+}
+
+type fakeLagProbe struct {
+	lags  sync.Map
+	calls int32
+}
+
+func (p *fakeLagProbe) Lag(ctx context.Context, db *DB) (time.Duration, error) {
+	atomic.AddInt32(&p.calls, 1)
+	value, ok := p.lags.Load(db)
+	if !ok {
+		return 0, nil
+	}
+	if err, ok := value.(error); ok {
+		return 0, err
+	}
+	return value.(time.Duration), nil
+}
+
+func TestMasterSlaveLag(t *testing.T) {
+	ctx := context.Background()
+
+	probe := &fakeLagProbe{}
+	var down sync.Map
+	config := masterSlaveConfig("sqlite_lag", 2)
+	config.HealthCheck = &HealthCheckConfig{
+		MaxLag:   time.Second,
+		LagProbe: probe,
+		Check: func(ctx context.Context, db *DB) error {
+			if _, ok := down.Load(db); ok {
+				return errors.New("replica down")
+			}
+			return nil
+		},
+	}
+	s := newMasterSlaveStorage(config)
+	master, r1, r2 := s.master.db, s.slaves[0].db, s.slaves[1].db
+
+	// 延迟超过限制的从库不再读
+	probe.lags.Store(r1, 5*time.Second)
+	probe.lags.Store(r2, 100*time.Millisecond)
+	s.CheckHealth(ctx)
+	if dbs := pickDBs(s, 4); dbs[r2] != 4 {
+		t.Fatalf("read should skip lagging replica, dbs = %v", dbs)
+	}
+	health := s.Health()
+	if !health[0].Healthy || !health[0].Lagging || health[0].Lag != 5*time.Second || health[1].Lagging {
+		t.Fatalf("lag status fail, health = %+v", health)
+	}
+
+	// 检查失败也认为延迟过大，没有可用的从库时读主库
+	probe.lags.Store(r2, errors.New("replication stopped"))
+	s.CheckHealth(ctx)
+	if dbs := pickDBs(s, 2); dbs[master] != 2 {
+		t.Fatalf("read should fall back to master, dbs = %v", dbs)
+	}
+	if health = s.Health(); !health[1].Lagging || health[1].LagError == nil {
+		t.Fatalf("lag error status fail, health = %+v", health)
+	}
+
+	// 追上之后恢复
+	probe.lags.Store(r1, 500*time.Millisecond)
+	probe.lags.Delete(r2)
+	s.CheckHealth(ctx)
+	if dbs := pickDBs(s, 4); dbs[r1] != 2 || dbs[r2] != 2 {
+		t.Fatalf("caught up replica should be read, dbs = %v", dbs)
+	}
+
+	// 不健康的从库不检查延迟
+	down.Store(r1, true)
+	atomic.StoreInt32(&probe.calls, 0)
+	s.CheckHealth(ctx)
+	if calls := atomic.LoadInt32(&probe.calls); calls != 1 {
+		t.Errorf("unhealthy replica should not probe lag, calls = %d", calls)
+	}
+}
+
+func TestMasterSlaveLagProbeNotFound(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("sqlite has no default lag probe, should panic")
+		}
+	}()
+
+	config := masterSlaveConfig("sqlite_lag_probe", 1)
+	config.HealthCheck = &HealthCheckConfig{MaxLag: time.Second}
+	newMasterSlaveStorage(config)
+}
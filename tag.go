@@ -15,6 +15,7 @@ const (
 	Column KeyTag = iota + 1
 	Readonly
 	PK
+	Default
 )
 
 func (t KeyTag) String() string {
@@ -25,6 +26,8 @@ func (t KeyTag) String() string {
 		return "readonly"
 	case PK:
 		return "pk"
+	case Default:
+		return "default"
 	}
 
 	return ""
@@ -35,6 +38,7 @@ type TagInfo struct {
 	Column    string
 	Readonly  bool
 	PK        bool
+	Default   bool
 }
 
 func LookUp(st reflect.StructTag) TagInfo {
@@ -58,6 +62,8 @@ func LookUp(st reflect.StructTag) TagInfo {
 			info.Readonly = true
 		case PK.String():
 			info.PK = true
+		case Default.String():
+			info.Default = true
 		}
 	}
 
@@ -0,0 +1,147 @@
+package porm
+
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
+// tracker 记录查询出来的 model 的列值，UpdateModel 时只更新有变化的列
+type tracker struct {
+	mu        sync.Mutex
+	snapshots map[interface{}]map[string]interface{}
+}
+
+func newTracker() *tracker {
+	return &tracker{snapshots: make(map[interface{}]map[string]interface{})}
+}
+
+// WithTracking 返回记录查询结果的 context，使用这个 context Select 出来的 model，UpdateModel 时只更新有变化的列；
+// 快照保存在 context 中，和 context 一起释放，一般每个请求使用一个
+func WithTracking(ctx context.Context) context.Context {
+	return context.WithValue(ctx, trackerKey, newTracker())
+}
+
+func trackerFrom(ctx context.Context) *tracker {
+	if value, ok := ctx.Value(trackerKey).(*tracker); ok {
+		return value
+	}
+	return nil
+}
+
+func (t *tracker) visitor(mapper *mapper) func(ptr reflect.Value) error {
+	return func(ptr reflect.Value) error {
+		return t.snapshot(mapper, ptr)
+	}
+}
+
+func (t *tracker) snapshot(mapper *mapper, ptr reflect.Value) error {
+	save, err := t.capture(mapper, ptr)
+	if err != nil {
+		return err
+	}
+	save()
+	return nil
+}
+
+// capture 复制 model 当前的列值，调用返回的方法时才保存快照，事务中的修改在提交后再保存
+func (t *tracker) capture(mapper *mapper, ptr reflect.Value) (func(), error) {
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return func() {}, nil
+	}
+
+	value := ptr.Elem()
+	sm, err := mapper.Load(value.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := make(map[string]interface{}, len(sm.Columns))
+	for _, column := range sm.Columns {
+		snapshot[column.Name] = copyValue(value.FieldByIndex(column.Index))
+	}
+
+	key := ptr.Interface()
+	return func() {
+		t.mu.Lock()
+		t.snapshots[key] = snapshot
+		t.mu.Unlock()
+	}, nil
+}
+
+// watch 在扫描到 model 之前调用，返回的方法在扫描之后调用：
+// 非指针元素的 slice 扩容后，之前的元素地址发生了变化，快照移到新的地址上
+func (t *tracker) watch(model interface{}) func() {
+	dv := reflect.Indirect(reflect.ValueOf(model))
+	if t == nil || dv.Kind() != reflect.Slice || dv.Type().Elem().Kind() == reflect.Ptr || dv.Len() == 0 {
+		return func() {}
+	}
+
+	keys := make([]interface{}, dv.Len())
+	for i := range keys {
+		keys[i] = dv.Index(i).Addr().Interface()
+	}
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		for i, key := range keys {
+			moved := dv.Index(i).Addr().Interface()
+			// 第一个元素的地址没有变化时没有扩容
+			if moved == key {
+				return
+			}
+			if snapshot, ok := t.snapshots[key]; ok {
+				delete(t.snapshots, key)
+				t.snapshots[moved] = snapshot
+			}
+		}
+	}
+}
+
+// changed 返回有变化的列，没有快照时 ok 为 false
+func (t *tracker) changed(sm StructMapper, ptr reflect.Value) (columns map[string]bool, ok bool) {
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return nil, false
+	}
+
+	t.mu.Lock()
+	snapshot, ok := t.snapshots[ptr.Interface()]
+	t.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	value := ptr.Elem()
+	columns = make(map[string]bool)
+	for _, column := range sm.Columns {
+		if !reflect.DeepEqual(snapshot[column.Name], value.FieldByIndex(column.Index).Interface()) {
+			columns[column.Name] = true
+		}
+	}
+	return columns, true
+}
+
+// copyValue 复制指针和 slice 指向的值，通过指针修改的列也能比较出来
+func copyValue(value reflect.Value) interface{} {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() {
+			break
+		}
+		cp := reflect.New(value.Type().Elem())
+		if elem := reflect.ValueOf(copyValue(value.Elem())); elem.IsValid() {
+			cp.Elem().Set(elem)
+		}
+		return cp.Interface()
+	case reflect.Slice:
+		if value.IsNil() {
+			break
+		}
+		cp := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		reflect.Copy(cp, value)
+		return cp.Interface()
+	}
+	return value.Interface()
+}
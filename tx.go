@@ -0,0 +1,397 @@
+package porm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yongpi/putil/plog"
+)
+
+// Propagation 事务传播方式，零值为 PropagationRequired
+type Propagation int
+
+const (
+	// PropagationRequired 已经在事务中时加入事务（默认使用 savepoint），否则开启新事务
+	PropagationRequired Propagation = iota
+	// PropagationRequiresNew 挂起外层事务，开启一个独立的新事务
+	PropagationRequiresNew
+	// PropagationNested 已经在事务中时使用 savepoint 嵌套，否则开启新事务
+	PropagationNested
+	// PropagationSupports 已经在事务中时加入事务，否则不使用事务
+	PropagationSupports
+	// PropagationNotSupported 挂起外层事务，不使用事务
+	PropagationNotSupported
+	// PropagationMandatory 必须已经在事务中，否则返回错误
+	PropagationMandatory
+	// PropagationNever 不使用事务，已经在事务中时返回错误
+	PropagationNever
+)
+
+func (p Propagation) String() string {
+	switch p {
+	case PropagationRequired:
+		return "required"
+	case PropagationRequiresNew:
+		return "requires_new"
+	case PropagationNested:
+		return "nested"
+	case PropagationSupports:
+		return "supports"
+	case PropagationNotSupported:
+		return "not_supported"
+	case PropagationMandatory:
+		return "mandatory"
+	case PropagationNever:
+		return "never"
+	}
+	return fmt.Sprintf("propagation(%d)", int(p))
+}
+
+// TxOptions 事务选项，Isolation 和 ReadOnly 只在开启新事务时生效，Retry 只在 Transaction 开启最外层事务时生效
+type TxOptions struct {
+	Propagation Propagation
+	Isolation   sql.IsolationLevel
+	ReadOnly    bool
+	Retry       *RetryPolicy
+}
+
+// RetryPolicy 事务重试策略，出现可以重试的错误时在新的事务中重新执行
+type RetryPolicy struct {
+	// MaxAttempts 最多执行的次数，包含第一次
+	MaxAttempts int
+	// Backoff 第一次重试前的等待时间，之后每次翻倍
+	Backoff time.Duration
+	// MaxBackoff 等待时间的上限，为 0 时不限制
+	MaxBackoff time.Duration
+	// Retryable 判断错误是否可以重试，为空时使用 Dialect.IsRetryable
+	Retryable func(err error) bool
+}
+
+func (p *RetryPolicy) retryable(dialect Dialect, err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return dialect.IsRetryable(err)
+}
+
+// delay 指数退避，随机取 [d/2, d) 之间的值，避免冲突的事务同时重试
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// TxRetry 事务重试的信息，BeforeTxRetry hook 中可以通过 TxRetryFromContext 获取
+type TxRetry struct {
+	// Attempt 已经执行失败的次数
+	Attempt int
+	Err     error
+	Delay   time.Duration
+}
+
+func (opts TxOptions) sqlTxOptions() *sql.TxOptions {
+	if opts.Isolation == sql.LevelDefault && !opts.ReadOnly {
+		return nil
+	}
+	return &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly}
+}
+
+// txOptions 只使用第一个选项
+func txOptions(options []TxOptions) TxOptions {
+	if len(options) == 0 {
+		return TxOptions{}
+	}
+	return options[0]
+}
+
+// transaction 同一个事务中的 orm 共享，嵌套的事务使用 savepoint 实现；tx 为空时表示不使用事务的作用域
+type transaction struct {
+	mu sync.Mutex
+	tx *Tx
+	// db 事务所在的库，分片的 storage 只有同一个库的分片可以加入
+	db *DB
+	// ctx 开启事务时的 context，事务结束的 hook 中使用
+	ctx context.Context
+	// levels 每一层事务，最外层和平铺加入的层没有 savepoint
+	levels []*txLevel
+	// rolledBack 已经回滚到 savepoint 的层注册的 OnRollback 回调，事务结束时一定执行
+	rolledBack []txCallback
+	seq        int
+	done       bool
+}
+
+type txLevel struct {
+	savepoint string
+	// ctx 创建 savepoint 时的 context，释放或者回滚 savepoint 时使用
+	ctx        context.Context
+	onCommit   []txCallback
+	onRollback []txCallback
+}
+
+// txExec 执行 SAVEPOINT 等事务控制语句，由 orm 提供，语句经过拦截器和 exec hook
+type txExec func(ctx context.Context, tx *Tx, query string) error
+
+type txCallback struct {
+	ctx context.Context
+	fun func(ctx context.Context)
+}
+
+func newTransaction(ctx context.Context, tx *Tx, db *DB) *transaction {
+	return &transaction{tx: tx, db: db, ctx: ctx, levels: []*txLevel{{}}}
+}
+
+// active 作用域还没有结束
+func (t *transaction) active() bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.done
+}
+
+// live 返回进行中的事务，不在事务中时返回 nil
+func (t *transaction) live() *Tx {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return nil
+	}
+	return t.tx
+}
+
+// outermost 是否是最外层的事务
+func (t *transaction) outermost() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tx != nil && !t.done && len(t.levels) == 1
+}
+
+// join 加入事务，savepoint 为 false 时和外层事务共用同一层
+func (t *transaction) join(ctx context.Context, savepoint bool, exec txExec) (string, error) {
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return "", fmt.Errorf("[porm:transaction:join]: tx has already finished")
+	}
+	if !savepoint || t.tx == nil {
+		t.levels = append(t.levels, &txLevel{})
+		t.mu.Unlock()
+		return "", nil
+	}
+
+	t.seq++
+	name := fmt.Sprintf("porm_sp_%d", t.seq)
+	t.mu.Unlock()
+
+	// 拦截器和 hook 中可能会使用事务，执行语句时不能持有锁
+	err := exec(ctx, t.tx, "SAVEPOINT "+name)
+	if err != nil {
+		return "", err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.levels = append(t.levels, &txLevel{savepoint: name, ctx: ctx})
+	return name, nil
+}
+
+// register 在当前层注册回调，commit 为 true 时注册 OnCommit，否则注册 OnRollback
+func (t *transaction) register(ctx context.Context, fun func(ctx context.Context), commit bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done || len(t.levels) == 0 {
+		return fmt.Errorf("[porm:transaction:register]: tx has already finished")
+	}
+
+	level := t.levels[len(t.levels)-1]
+	if commit {
+		level.onCommit = append(level.onCommit, txCallback{ctx: ctx, fun: fun})
+	} else {
+		level.onRollback = append(level.onRollback, txCallback{ctx: ctx, fun: fun})
+	}
+	return nil
+}
+
+func (t *transaction) commit(exec txExec) error {
+	callbacks, err := t.finish(true, exec)
+	runTxCallbacks(callbacks)
+	return err
+}
+
+// rollback 嵌套的事务回滚到 savepoint，平铺加入的层不做处理，由最外层决定是否回滚
+func (t *transaction) rollback(exec txExec) error {
+	callbacks, err := t.finish(false, exec)
+	runTxCallbacks(callbacks)
+	return err
+}
+
+// finish 结束当前层，最外层结束时返回需要执行的回调；内层的回调合并到外层，回滚到 savepoint 时丢弃 OnCommit 回调
+func (t *transaction) finish(commit bool, exec txExec) ([]txCallback, error) {
+	t.mu.Lock()
+	if t.done || len(t.levels) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("[porm:transaction]: tx has already finished")
+	}
+
+	level := t.levels[len(t.levels)-1]
+	t.levels = t.levels[:len(t.levels)-1]
+
+	if len(t.levels) == 0 {
+		defer t.mu.Unlock()
+		t.done = true
+
+		var err error
+		if t.tx != nil && commit {
+			err = t.tx.Commit()
+		} else if t.tx != nil {
+			err = t.tx.Rollback()
+		}
+
+		// 提交失败时事务已经回滚
+		if commit && err == nil {
+			return append(level.onCommit, t.rolledBack...), nil
+		}
+		return append(level.onRollback, t.rolledBack...), err
+	}
+
+	parent := t.levels[len(t.levels)-1]
+	if commit || level.savepoint == "" {
+		parent.onCommit = append(parent.onCommit, level.onCommit...)
+		parent.onRollback = append(parent.onRollback, level.onRollback...)
+	} else {
+		t.rolledBack = append(t.rolledBack, level.onRollback...)
+	}
+	t.mu.Unlock()
+
+	if level.savepoint == "" {
+		return nil, nil
+	}
+	if commit {
+		return nil, exec(level.ctx, t.tx, "RELEASE SAVEPOINT "+level.savepoint)
+	}
+	return nil, exec(level.ctx, t.tx, "ROLLBACK TO SAVEPOINT "+level.savepoint)
+}
+
+// runTxCallbacks 回调中的 panic 不影响事务的结果
+func runTxCallbacks(callbacks []txCallback) {
+	for _, callback := range callbacks {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					plog.Errorf("[porm:transaction]: callback panic, err = %v", err)
+				}
+			}()
+			callback.fun(callback.ctx)
+		}()
+	}
+}
+
+// MultiCommitError 多个 storage 的事务部分提交成功
+type MultiCommitError struct {
+	// Committed 已经提交的 storage
+	Committed []string
+	// Failed 提交失败的 storage
+	Failed string
+	Err    error
+	// RolledBack 提交失败后回滚的 storage
+	RolledBack []string
+	// RollbackErrors 回滚失败的 storage
+	RollbackErrors map[string]error
+}
+
+func (e *MultiCommitError) Error() string {
+	return fmt.Sprintf("[porm:MultiTransaction]: commit fail, storage = %s, committed = [%s], rolled back = [%s], err = %s",
+		e.Failed, strings.Join(e.Committed, ","), strings.Join(e.RolledBack, ","), e.Err)
+}
+
+func (e *MultiCommitError) Unwrap() error {
+	return e.Err
+}
+
+// MultiTransaction 在多个 storage 上开启事务，fun 成功后按传入的顺序依次提交，不保证原子性；
+// 某个 storage 提交失败时回滚剩下的事务，返回 *MultiCommitError
+func MultiTransaction(ctx context.Context, fun func(ctx context.Context, orms []*orm) error, orms ...*orm) (err error) {
+	names := make(map[string]bool)
+	for _, o := range orms {
+		if names[o.StorageName()] {
+			return fmt.Errorf("[porm:MultiTransaction]: duplicate storage, storage = %s", o.StorageName())
+		}
+		names[o.StorageName()] = true
+	}
+
+	var txORMs []*orm
+	rollback := func(list []*orm) map[string]error {
+		errs := make(map[string]error)
+		for i := len(list) - 1; i >= 0; i-- {
+			if err := list[i].Rollback(); err != nil {
+				errs[list[i].StorageName()] = err
+			}
+		}
+		return errs
+	}
+
+	for _, o := range orms {
+		no, err := o.BeginTx(ctx)
+		if err != nil {
+			rollback(txORMs)
+			return err
+		}
+		txORMs = append(txORMs, no)
+		ctx = WithTxContext(ctx, no)
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			rollback(txORMs)
+			panic(e)
+		}
+	}()
+
+	err = fun(ctx, txORMs)
+	if err != nil {
+		for name, err2 := range rollback(txORMs) {
+			plog.WithError(err2).Errorf("[porm:MultiTransaction]: rollback fail, storage = %s", name)
+		}
+		return err
+	}
+
+	var committed []string
+	for index, no := range txORMs {
+		err = no.Commit()
+		if err == nil {
+			committed = append(committed, no.StorageName())
+			continue
+		}
+
+		rest := txORMs[index+1:]
+		me := &MultiCommitError{Committed: committed, Failed: no.StorageName(), Err: err, RollbackErrors: rollback(rest)}
+		for _, ro := range rest {
+			if _, ok := me.RollbackErrors[ro.StorageName()]; !ok {
+				me.RolledBack = append(me.RolledBack, ro.StorageName())
+			}
+		}
+		return me
+	}
+
+	return nil
+}